@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var approvals = NewApprovals(time.Hour)
+
+// Approvals keeps track of requests that need a second person to approve them before
+// they run.
+type Approvals struct {
+	// Timeout is how long a request waits for approval before it expires.
+	Timeout time.Duration
+	// Roles decides who can approve requests. If it is nil, anyone other than the requester
+	// can approve them.
+	Roles *Roles
+
+	mu      sync.Mutex
+	pending map[string]*pendingApproval
+}
+
+type pendingApproval struct {
+	conv  Conversation
+	msg   *MessageBuilder
+	text  string
+	role  string
+	fn    func(ctx context.Context, approver string)
+	timer *time.Timer
+}
+
+// NewApprovals creates an empty set of approval requests that expire after the timeout.
+func NewApprovals(timeout time.Duration) *Approvals {
+	return &Approvals{
+		Timeout: timeout,
+		pending: make(map[string]*pendingApproval),
+	}
+}
+
+// RequestApproval queues an action until someone other than the user who started the
+// conversation approves it.
+//
+// The message is sent with Approve and Reject buttons, and a request ID that can be used
+// with the `approve` and `reject` commands instead. The approver needs the given role.
+// When the request is approved, fn runs with the ID of the user who approved it.
+func RequestApproval(conv Conversation, msg *MessageBuilder, role string, fn func(ctx context.Context, approver string)) {
+	approvals.Request(conv, msg, role, fn)
+}
+
+// Request queues an action until someone other than the user who started the conversation
+// approves it.
+func (a *Approvals) Request(conv Conversation, msg *MessageBuilder, role string, fn func(ctx context.Context, approver string)) {
+	id := randomID()
+	p := &pendingApproval{
+		conv: conv,
+		msg:  msg,
+		role: role,
+		fn:   fn,
+	}
+
+	msg.text = fmt.Sprintf("%s\nThis needs approval from someone else with the %s role. Click Approve or say `approve %s`.", msg.text, role, id)
+	p.text = msg.text
+
+	a.mu.Lock()
+	a.pending[id] = p
+	p.timer = time.AfterFunc(a.Timeout, func() {
+		a.expire(id)
+	})
+	a.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"request": id,
+		"user":    conv.User(),
+		"role":    role,
+	}).Info("waiting for approval")
+
+	msg.CallbackID("approve:"+id).
+		Button("approve", "Approve", "primary").
+		Button("reject", "Reject", "danger").
+		Send()
+}
+
+// Approve runs a pending request on behalf of the user approving it.
+//
+// Requests can't be approved by the user who made them, or by users without the role the
+// request needs.
+func (a *Approvals) Approve(ctx context.Context, id string, approver string) error {
+	p, err := a.take(ctx, id, approver, false)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"request":  id,
+		"approver": approver,
+	}).Info("request approved")
+	p.resolve(":white_check_mark: Approved by <@%s>.", approver)
+	auditFollowUp(p.conv, "", func() {
+		p.fn(ctx, approver)
+	})
+	return nil
+}
+
+// Reject drops a pending request without running it. The user who made the request can
+// reject it to withdraw it.
+func (a *Approvals) Reject(ctx context.Context, id string, user string) error {
+	p, err := a.take(ctx, id, user, true)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"request": id,
+		"user":    user,
+	}).Info("request rejected")
+	p.resolve(":no_entry_sign: Rejected by <@%s>.", user)
+	auditFollowUp(p.conv, auditRejected, nil)
+	return nil
+}
+
+// take removes a pending request if the user is allowed to resolve it.
+func (a *Approvals) take(ctx context.Context, id string, user string, requesterAllowed bool) (*pendingApproval, error) {
+	a.mu.Lock()
+	p, found := a.pending[id]
+	a.mu.Unlock()
+
+	if !found {
+		return nil, fmt.Errorf("there is no request waiting for approval with ID `%s`", id)
+	}
+
+	isRequester := p.conv.User() == user
+	if isRequester && !requesterAllowed {
+		return nil, fmt.Errorf("you can't approve your own request")
+	}
+
+	if !isRequester && a.Roles != nil {
+		ok, err := a.Roles.HasRole(ctx, user, p.role)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("only someone with the %s role can do that", p.role)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Someone else may have resolved the request while we were checking roles
+	if _, found := a.pending[id]; !found {
+		return nil, fmt.Errorf("there is no request waiting for approval with ID `%s`", id)
+	}
+	delete(a.pending, id)
+	p.timer.Stop()
+
+	return p, nil
+}
+
+// HandleAction approves or rejects a request when someone clicks one of its buttons. If
+// they can't, they are told why in a direct message.
+func (a *Approvals) HandleAction(ctx context.Context, act Action) {
+	id := strings.TrimPrefix(act.CallbackID, "approve:")
+
+	var err error
+	switch act.Name {
+	case "approve":
+		err = a.Approve(ctx, id, act.User)
+	default:
+		err = a.Reject(ctx, id, act.User)
+	}
+	if err == nil {
+		return
+	}
+
+	entry := log.WithError(err).WithFields(log.Fields{
+		"request": id,
+		"user":    act.User,
+	})
+	entry.Warn("could not resolve request")
+
+	conv, convErr := notifyUser(act.User)
+	if convErr != nil {
+		entry.WithError(convErr).Error("could not message user")
+		return
+	}
+	ReplyTo(conv).ErrorText("I couldn't %s that request: %s.", act.Name, err).Send()
+}
+
+func (a *Approvals) expire(id string) {
+	a.mu.Lock()
+	p, found := a.pending[id]
+	delete(a.pending, id)
+	a.mu.Unlock()
+
+	if found {
+		log.WithField("request", id).Info("request expired")
+		p.resolve(":hourglass: Nobody approved this in time, so I didn't do anything.")
+		auditFollowUp(p.conv, auditExpired, nil)
+	}
+}
+
+// resolve removes the buttons from the request message and notes what happened to it.
+func (p *pendingApproval) resolve(status string, args ...interface{}) {
+	p.msg.ClearButtons().
+		Color("").
+		AttachText("%s\n"+status, append([]interface{}{p.text}, args...)...).
+		Send()
+}
+
+// ApproveRequest approves a pending request by its ID.
+func ApproveRequest(ctx context.Context, conv Conversation) {
+	id := conv.String("request")
+	if err := approvals.Approve(ctx, id, conv.User()); err != nil {
+		ReplyTo(conv).ErrorText("I couldn't approve that request: %s.", err).Send()
+	}
+}
+
+// RejectRequest rejects a pending request by its ID.
+func RejectRequest(ctx context.Context, conv Conversation) {
+	id := conv.String("request")
+	if err := approvals.Reject(ctx, id, conv.User()); err != nil {
+		ReplyTo(conv).ErrorText("I couldn't reject that request: %s.", err).Send()
+	}
+}
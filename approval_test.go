@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTestJobBoard points the production job board at a test server that records the
+// requests it receives.
+func setupTestJobBoard() (*[]string, func()) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "GET" {
+			w.Write([]byte(`{"data": []}`))
+		}
+	}))
+
+	jobBoards = map[string]*JobBoard{"production": NewJobBoard(srv.URL, "secret")}
+	requireApproval = map[string]bool{"production": true}
+	approvals = NewApprovals(time.Hour)
+	setupBaseImages("my-image")
+
+	return &requests, func() {
+		srv.Close()
+		jobBoards = nil
+		requireApproval = nil
+	}
+}
+
+func approvalID(conv *testConversation) string {
+	return strings.TrimPrefix(conv.replies[0].callbackID, "approve:")
+}
+
+func registerImageForTest() *testConversation {
+	conv := newTestConversation("register image my-image as xcode10")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "my-image",
+		"tag":   "xcode10",
+	}))
+	RegisterImage(context.TODO(), conv)
+	return conv
+}
+
+func TestRegisterImageNeedsApproval(t *testing.T) {
+	requests, done := setupTestJobBoard()
+	defer done()
+
+	conv := registerImageForTest()
+
+	require.Len(t, conv.replies, 1)
+	require.Contains(t, conv.replies[0].text, "<@user> wants to register an image in job-board-production.")
+	require.Contains(t, conv.replies[0].text, "approve "+approvalID(conv))
+	require.Equal(t, []string{"GET /images"}, *requests)
+
+	approver := newTestConversation("approve " + approvalID(conv))
+	approver.user = "approver"
+	approver.SetProperties(proper.NewProperties(map[string]string{
+		"request": approvalID(conv),
+	}))
+	ApproveRequest(context.TODO(), approver)
+
+	require.Empty(t, approver.replies)
+	require.Equal(t, []string{"GET /images", "GET /images", "POST /images"}, *requests)
+	require.Len(t, conv.replies, 3)
+	require.Contains(t, conv.replies[1].text, ":white_check_mark: Approved by <@approver>.")
+
+	reply := conv.replies[2]
+	require.Equal(t, "Successfully registered image for <@user>", reply.text)
+	require.Contains(t, reply.fields, messageField{title: "Requested by", value: "<@user>", short: true})
+	require.Contains(t, reply.fields, messageField{title: "Approved by", value: "<@approver>", short: true})
+}
+
+func TestApproveOwnRequest(t *testing.T) {
+	requests, done := setupTestJobBoard()
+	defer done()
+
+	conv := registerImageForTest()
+
+	err := approvals.Approve(context.TODO(), approvalID(conv), "user")
+	require.EqualError(t, err, "you can't approve your own request")
+	require.Equal(t, []string{"GET /images"}, *requests)
+}
+
+func TestApproveWithoutRole(t *testing.T) {
+	requests, done := setupTestJobBoard()
+	defer done()
+	approvals.Roles = NewRoles(map[string]*RoleConfig{
+		roleReleaser: {Users: []string{"releaser"}},
+	}, nil)
+
+	conv := registerImageForTest()
+
+	err := approvals.Approve(context.TODO(), approvalID(conv), "someone")
+	require.EqualError(t, err, "only someone with the releaser role can do that")
+	require.NoError(t, approvals.Approve(context.TODO(), approvalID(conv), "releaser"))
+	require.Equal(t, []string{"GET /images", "GET /images", "POST /images"}, *requests)
+}
+
+func TestRejectRequestWithButton(t *testing.T) {
+	requests, done := setupTestJobBoard()
+	defer done()
+
+	conv := registerImageForTest()
+	approvals.HandleAction(context.TODO(), Action{
+		CallbackID: conv.replies[0].callbackID,
+		Name:       "reject",
+		User:       "user",
+	})
+
+	require.Equal(t, []string{"GET /images"}, *requests)
+	require.Contains(t, conv.replies[1].text, ":no_entry_sign: Rejected by <@user>.")
+
+	convs := captureNotifications()
+	approvals.HandleAction(context.TODO(), Action{
+		CallbackID: conv.replies[0].callbackID,
+		Name:       "approve",
+		User:       "approver",
+	})
+	require.Contains(t, convs["approver"].replies[0].text, "there is no request waiting for approval")
+}
+
+func TestApprovalExpires(t *testing.T) {
+	requests, done := setupTestJobBoard()
+	defer done()
+
+	conv := registerImageForTest()
+	approvals.expire(approvalID(conv))
+
+	require.Error(t, approvals.Approve(context.TODO(), approvalID(conv), "approver"))
+	require.Equal(t, []string{"GET /images"}, *requests)
+	require.Contains(t, conv.replies[1].text, ":hourglass: Nobody approved this in time")
+}
+
+func TestRegisterImageWithoutApproval(t *testing.T) {
+	requests, done := setupTestJobBoard()
+	defer done()
+	requireApproval = nil
+
+	conv := registerImageForTest()
+
+	require.Equal(t, []string{"GET /images", "GET /images", "POST /images"}, *requests)
+	require.Equal(t, "Successfully registered image for <@user>", conv.replies[0].text)
+	require.Len(t, conv.replies[0].fields, 4)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// Results recorded in the audit log.
+const (
+	auditOK        = "ok"
+	auditError     = "error"
+	auditDenied    = "denied"
+	auditUnknown   = "unknown command"
+	auditPending   = "awaiting confirmation"
+	auditCancelled = "cancelled"
+	auditRejected  = "rejected"
+	auditExpired   = "expired"
+)
+
+// auditLog records every command the bot handles. If it is nil, nothing is recorded.
+var auditLog *AuditLog
+
+// AuditEntry is a record of a command someone ran and how it turned out.
+type AuditEntry struct {
+	User       string    `json:"user"`
+	Channel    string    `json:"channel"`
+	Command    string    `json:"command"`
+	Pattern    string    `json:"pattern,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog is an append-only log of commands.
+//
+// If the log has a path, entries are appended to that file as JSON lines, so they survive
+// the bot restarting. Otherwise they are only kept in memory.
+type AuditLog struct {
+	path    string
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// NewAuditLog creates an audit log that appends to the file at path. An empty path creates
+// a log that only lives in memory.
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// Record adds an entry to the log.
+func (a *AuditLog) Record(e AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.path == "" {
+		a.entries = append(a.entries, e)
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Search returns the entries that started at or after since, newest first. If user is not
+// empty, only that user's entries are returned.
+func (a *AuditLog) Search(user string, since time.Time) ([]AuditEntry, error) {
+	all, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	for i := len(all) - 1; i >= 0; i-- {
+		e := all[i]
+		if e.StartedAt.Before(since) || (user != "" && e.User != user) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func (a *AuditLog) read() ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.path == "" {
+		return append([]AuditEntry(nil), a.entries...), nil
+	}
+
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A partly written line shouldn't hide the rest of the log
+			log.WithError(err).WithField("path", a.path).Warn("skipping bad audit log line")
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// auditedConversation watches the replies sent to a conversation so that the outcome of
+// the command can be recorded in the audit log.
+type auditedConversation struct {
+	Conversation
+
+	mu      sync.Mutex
+	entry   AuditEntry
+	failed  bool
+	pending bool
+}
+
+func newAuditedConversation(conv Conversation) *auditedConversation {
+	return &auditedConversation{
+		Conversation: conv,
+		entry: AuditEntry{
+			User:    conv.User(),
+			Channel: conv.Channel(),
+			Command: conv.CommandText(),
+		},
+	}
+}
+
+// Send notes whether the handler reported an error or asked for confirmation, then sends the
+// message as usual.
+func (c *auditedConversation) Send(b *MessageBuilder) string {
+	c.mu.Lock()
+	if b.color == "danger" && b.callbackID == "" {
+		c.failed = true
+		c.entry.Error = b.text
+		if b.error != nil {
+			c.entry.Error += ": " + b.error.Error()
+		}
+	}
+	if b.callbackID != "" && len(b.buttons) > 0 {
+		c.pending = true
+	}
+	c.mu.Unlock()
+
+	return c.Conversation.Send(b)
+}
+
+// begin starts timing the work done for a command. An empty pattern keeps the pattern
+// that was matched before.
+func (c *auditedConversation) begin(pattern string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pattern != "" {
+		c.entry.Pattern = pattern
+	}
+	c.entry.StartedAt = time.Now()
+	c.entry.Error = ""
+	c.failed = false
+	c.pending = false
+}
+
+// finish records the outcome of the command. If result is empty, it is worked out from
+// the replies that were sent.
+func (c *auditedConversation) finish(result string) {
+	c.mu.Lock()
+	e := c.entry
+	switch {
+	case result != "":
+	case c.failed:
+		result = auditError
+	case c.pending:
+		result = auditPending
+	default:
+		result = auditOK
+	}
+	c.mu.Unlock()
+
+	e.Result = result
+	e.FinishedAt = time.Now()
+	commandsHandled.WithLabelValues(e.Pattern, result).Inc()
+	commandDuration.WithLabelValues(e.Pattern).Observe(e.FinishedAt.Sub(e.StartedAt).Seconds())
+	if err := auditLog.Record(e); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"user":    e.User,
+			"command": e.Command,
+		}).Error("could not record command in audit log")
+	}
+}
+
+// auditFollowUp records work done for a command after its handler has returned, like
+// running it once it has been confirmed. If result is empty, fn is run and the result is
+// worked out from its replies.
+func auditFollowUp(conv Conversation, result string, fn func()) {
+	ac, ok := conv.(*auditedConversation)
+	if !ok {
+		if fn != nil {
+			fn()
+		}
+		return
+	}
+
+	ac.begin("")
+	if fn != nil {
+		fn()
+	}
+	ac.finish(result)
+}
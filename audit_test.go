@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macbot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+	now := time.Now()
+	a := NewAuditLog(path)
+	require.NoError(t, a.Record(AuditEntry{User: "alice", Command: "one", StartedAt: now.Add(-2 * time.Hour)}))
+	require.NoError(t, a.Record(AuditEntry{User: "bob", Command: "two", StartedAt: now.Add(-time.Minute)}))
+	require.NoError(t, a.Record(AuditEntry{User: "alice", Command: "three", StartedAt: now}))
+
+	entries, err := NewAuditLog(path).Search("", now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "three", entries[0].Command)
+	require.Equal(t, "two", entries[1].Command)
+
+	entries, err = NewAuditLog(path).Search("alice", time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "one", entries[1].Command)
+}
+
+func TestRouterRecordsAuditLog(t *testing.T) {
+	auditLog = NewAuditLog("")
+	defer func() { auditLog = nil }()
+
+	router := NewRouter()
+	router.HandleFunc("works", func(_ context.Context, conv Conversation) {
+		ReplyTo(conv).Text("Done").Send()
+	})
+	router.HandleFunc("fails", func(_ context.Context, conv Conversation) {
+		ReplyTo(conv).ErrorText("It broke.").Send()
+	})
+
+	router.Reply(context.TODO(), newTestConversation("works"))
+	router.Reply(context.TODO(), newTestConversation("fails"))
+	router.Reply(context.TODO(), newTestConversation("nonsense"))
+
+	entries, err := auditLog.Search("", time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	require.Equal(t, "nonsense", entries[0].Command)
+	require.Equal(t, auditUnknown, entries[0].Result)
+
+	require.Equal(t, "fails", entries[1].Pattern)
+	require.Equal(t, auditError, entries[1].Result)
+	require.Equal(t, "Sorry, <@user>! It broke.", entries[1].Error)
+
+	require.Equal(t, "user", entries[2].User)
+	require.Equal(t, "test", entries[2].Channel)
+	require.Equal(t, auditOK, entries[2].Result)
+	require.False(t, entries[2].FinishedAt.Before(entries[2].StartedAt))
+}
+
+func TestAuditLogRecordsConfirmedCommand(t *testing.T) {
+	resetBackend()
+	auditLog = NewAuditLog("")
+	defer func() { auditLog = nil }()
+
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
+
+	router := NewRouter()
+	router.HandleFunc("check in host", CheckInHost)
+	conv := newTestConversation("check in host")
+	router.Reply(context.TODO(), conv)
+	clickButton(conv, "user", "confirm")
+
+	entries, err := auditLog.Search("", time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, auditOK, entries[0].Result)
+	require.Equal(t, "check in host", entries[0].Pattern)
+	require.Equal(t, auditPending, entries[1].Result)
+}
+
+func TestAuditLogEntries(t *testing.T) {
+	auditLog = NewAuditLog("")
+	defer func() { auditLog = nil }()
+
+	auditLog.Record(AuditEntry{User: "U0ALICE", Channel: "C1", Command: "check out host", StartedAt: time.Now(), Result: auditOK})
+	auditLog.Record(AuditEntry{User: "U0BOB", Channel: "C1", Command: "restore backup x", StartedAt: time.Now(), Result: auditError})
+
+	conv := newTestConversation("audit log for <@u0alice>")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"user": "<@u0alice>",
+	}))
+	AuditLogEntries(context.TODO(), conv)
+
+	reply := conv.replies[0]
+	require.Contains(t, reply.text, "Commands run by <@U0ALICE> in the last 24h0m0s:")
+	require.Contains(t, reply.text, "`check out host` by <@U0ALICE> in <#C1>")
+	require.NotContains(t, reply.text, "restore backup")
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/travis-ci/vsphere-images"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -24,20 +32,24 @@ type Image interface {
 //
 // The Backend interface simplifies the chat command logic and allows us to substitute in
 // a debug backend for testing chat interactions.
+//
+// Every operation takes the name of the pod (datacenter) it should act on, such as "pod-1".
 type Backend interface {
-	IsHostCheckedOut(context.Context) (bool, error)
-	SelectHost(context.Context) (Host, error)
-	CheckOutHost(context.Context, Host) error
-	CheckInHost(context.Context) (Host, error)
+	CheckedOutHosts(context.Context, string) ([]Host, error)
+	SelectHost(context.Context, string) (Host, error)
+	CheckOutHost(context.Context, string, Host) error
+	CheckInHost(context.Context, string, Host) error
 
-	BaseImages(context.Context) ([]Image, error)
-	RestoreBackup(context.Context, string) error
+	BaseImages(context.Context, string) ([]Image, error)
+	DeleteBaseImage(context.Context, string, string) error
+	RestoreBackup(context.Context, string, string) error
 }
 
 // VSphereBackend is the default backend, which communicates with a vSphere instance.
+//
+// Datacenters maps pod names to the configuration for that pod's datacenter.
 type VSphereBackend struct {
-	Pod1 DatacenterConfig
-	Pod2 DatacenterConfig
+	Datacenters map[string]DatacenterConfig
 }
 
 // DatacenterConfig defines how to interact with one of our vSphere datacenters
@@ -51,24 +63,111 @@ type DatacenterConfig struct {
 	DatastorePath   string
 }
 
-func (b *VSphereBackend) IsHostCheckedOut(ctx context.Context) (bool, error) {
-	return vsphereimages.IsHostCheckedOut(ctx, b.Pod1.URL, b.Pod1.Insecure, b.Pod1.DevClusterPath)
+// CheckedOutHosts lists the hosts that are in a pod's dev cluster.
+func (b *VSphereBackend) CheckedOutHosts(ctx context.Context, pod string) ([]Host, error) {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return nil, err
+	}
+	if dc.DevClusterPath == "" {
+		return nil, fmt.Errorf("%s has no dev cluster configured", pod)
+	}
+
+	var hosts []Host
+	err = withClient(ctx, dc, func(c *govmomi.Client, f *find.Finder) error {
+		list, err := f.HostSystemList(ctx, dc.DevClusterPath+"/*")
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, h := range list {
+			hosts = append(hosts, h)
+		}
+		return nil
+	})
+
+	return hosts, err
 }
 
-func (b *VSphereBackend) SelectHost(ctx context.Context) (Host, error) {
-	return vsphereimages.SelectAvailableHost(ctx, b.Pod1.URL, b.Pod1.Insecure, b.Pod1.ProdClusterPath)
+func (b *VSphereBackend) SelectHost(ctx context.Context, pod string) (Host, error) {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	return vsphereimages.SelectAvailableHost(ctx, dc.URL, dc.Insecure, dc.ProdClusterPath)
 }
 
-func (b *VSphereBackend) CheckOutHost(ctx context.Context, h Host) error {
-	return vsphereimages.CheckOutSelectedHost(ctx, b.Pod1.URL, b.Pod1.Insecure, h.(*object.HostSystem), b.Pod1.DevClusterPath, newProgressLogger())
+func (b *VSphereBackend) CheckOutHost(ctx context.Context, pod string, h Host) error {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return err
+	}
+	if dc.DevClusterPath == "" {
+		return fmt.Errorf("%s has no dev cluster configured", pod)
+	}
+
+	p := newProgressLogger(ctx)
+	defer p.Wait()
+
+	return vsphereimages.CheckOutSelectedHost(ctx, dc.URL, dc.Insecure, h.(*object.HostSystem), dc.DevClusterPath, p)
 }
 
-func (b *VSphereBackend) CheckInHost(ctx context.Context) (Host, error) {
-	return vsphereimages.CheckInHost(ctx, b.Pod1.URL, b.Pod1.Insecure, b.Pod1.DevClusterPath, b.Pod1.ProdClusterPath, newProgressLogger())
+// CheckInHost moves a host from a pod's dev cluster back into its production cluster.
+//
+// The host is put into maintenance mode while it is moved, and taken back out once it is in
+// the production cluster.
+func (b *VSphereBackend) CheckInHost(ctx context.Context, pod string, h Host) error {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return err
+	}
+
+	return withClient(ctx, dc, func(c *govmomi.Client, f *find.Finder) error {
+		cluster, err := f.ClusterComputeResource(ctx, dc.ProdClusterPath)
+		if err != nil {
+			return err
+		}
+
+		host := object.NewHostSystem(c.Client, h.(*object.HostSystem).Reference())
+
+		task, err := host.EnterMaintenanceMode(ctx, 0, true, nil)
+		if err != nil {
+			return err
+		}
+		if err = waitForTask(ctx, task); err != nil {
+			return err
+		}
+
+		resp, err := methods.MoveInto_Task(ctx, c.Client, &types.MoveInto_Task{
+			This: cluster.Reference(),
+			Host: []types.ManagedObjectReference{host.Reference()},
+		})
+		if err != nil {
+			return err
+		}
+		if err = waitForTask(ctx, object.NewTask(c.Client, resp.Returnval)); err != nil {
+			return err
+		}
+
+		task, err = host.ExitMaintenanceMode(ctx, 0)
+		if err != nil {
+			return err
+		}
+		return waitForTask(ctx, task)
+	})
 }
 
-func (b *VSphereBackend) BaseImages(ctx context.Context) ([]Image, error) {
-	vms, err := vsphereimages.ListImages(ctx, b.Pod1.URL, b.Pod1.Insecure, b.Pod1.BaseImagePath)
+func (b *VSphereBackend) BaseImages(ctx context.Context, pod string) ([]Image, error) {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := vsphereimages.ListImages(ctx, dc.URL, dc.Insecure, dc.BaseImagePath)
 	if err != nil {
 		return nil, err
 	}
@@ -81,9 +180,141 @@ func (b *VSphereBackend) BaseImages(ctx context.Context) ([]Image, error) {
 	return images, nil
 }
 
-func (b *VSphereBackend) RestoreBackup(ctx context.Context, image string) error {
-	image = b.Pod2.BackupImagePath + "/" + image
-	return vsphereimages.RestoreBackup(ctx, b.Pod2.URL, b.Pod2.Insecure, image, b.Pod2.BaseImagePath, b.Pod2.DatastorePath, b.Pod2.ProdClusterPath, newProgressLogger())
+// DeleteBaseImage destroys one of the base VMs in a pod, removing its files from the
+// datastore.
+func (b *VSphereBackend) DeleteBaseImage(ctx context.Context, pod string, image string) error {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return err
+	}
+
+	return withClient(ctx, dc, func(c *govmomi.Client, f *find.Finder) error {
+		vm, err := f.VirtualMachine(ctx, dc.BaseImagePath+"/"+image)
+		if err != nil {
+			return err
+		}
+
+		task, err := vm.Destroy(ctx)
+		if err != nil {
+			return err
+		}
+		return waitForTask(ctx, task)
+	})
+}
+
+func (b *VSphereBackend) RestoreBackup(ctx context.Context, pod string, image string) error {
+	dc, err := b.datacenter(pod)
+	if err != nil {
+		return err
+	}
+	if dc.BackupImagePath == "" || dc.DatastorePath == "" {
+		return fmt.Errorf("%s has no backup images configured", pod)
+	}
+
+	p := newProgressLogger(ctx)
+	defer p.Wait()
+
+	image = dc.BackupImagePath + "/" + image
+	return vsphereimages.RestoreBackup(ctx, dc.URL, dc.Insecure, image, dc.BaseImagePath, dc.DatastorePath, dc.ProdClusterPath, p)
+}
+
+// withClient logs in to the vCenter for a datacenter and calls fn with the client and a
+// finder for looking up inventory paths, logging out again once fn returns.
+func withClient(ctx context.Context, dc DatacenterConfig, fn func(*govmomi.Client, *find.Finder) error) error {
+	c, err := govmomi.NewClient(ctx, dc.URL, dc.Insecure)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	return fn(c, find.NewFinder(c.Client, false))
+}
+
+// waitForTask waits for a vSphere task to finish, returning its error if it failed.
+func waitForTask(ctx context.Context, task *object.Task) error {
+	p := newProgressLogger(ctx)
+	defer p.Wait()
+
+	_, err := task.WaitForResult(ctx, p)
+	if err != nil && ctx.Err() != nil {
+		// Stop the task in vSphere too, rather than leaving it running with nobody watching
+		if cancelErr := task.Cancel(context.Background()); cancelErr != nil {
+			log.WithError(cancelErr).Error("could not cancel vSphere task")
+		}
+	}
+	return err
+}
+
+// datacenter looks up the configuration for a pod by name.
+func (b *VSphereBackend) datacenter(pod string) (DatacenterConfig, error) {
+	dc, found := b.Datacenters[pod]
+	if !found {
+		return DatacenterConfig{}, fmt.Errorf("no datacenter is configured for %s", pod)
+	}
+
+	return dc, nil
+}
+
+// instrumentedBackend is a backend that keeps track of how long its operations take.
+type instrumentedBackend struct {
+	Backend
+}
+
+func (b instrumentedBackend) CheckedOutHosts(ctx context.Context, pod string) ([]Host, error) {
+	start := time.Now()
+	hosts, err := b.Backend.CheckedOutHosts(ctx, pod)
+	observeBackend("CheckedOutHosts", start, err)
+	return hosts, err
+}
+
+func (b instrumentedBackend) SelectHost(ctx context.Context, pod string) (Host, error) {
+	start := time.Now()
+	host, err := b.Backend.SelectHost(ctx, pod)
+	observeBackend("SelectHost", start, err)
+	return host, err
+}
+
+func (b instrumentedBackend) CheckOutHost(ctx context.Context, pod string, h Host) error {
+	start := time.Now()
+	err := b.Backend.CheckOutHost(ctx, pod, h)
+	observeBackend("CheckOutHost", start, err)
+	return err
+}
+
+func (b instrumentedBackend) CheckInHost(ctx context.Context, pod string, h Host) error {
+	start := time.Now()
+	err := b.Backend.CheckInHost(ctx, pod, h)
+	observeBackend("CheckInHost", start, err)
+	return err
+}
+
+func (b instrumentedBackend) BaseImages(ctx context.Context, pod string) ([]Image, error) {
+	start := time.Now()
+	images, err := b.Backend.BaseImages(ctx, pod)
+	observeBackend("BaseImages", start, err)
+	return images, err
+}
+
+func (b instrumentedBackend) DeleteBaseImage(ctx context.Context, pod string, image string) error {
+	start := time.Now()
+	err := b.Backend.DeleteBaseImage(ctx, pod, image)
+	observeBackend("DeleteBaseImage", start, err)
+	return err
+}
+
+func (b instrumentedBackend) RestoreBackup(ctx context.Context, pod string, image string) error {
+	start := time.Now()
+	err := b.Backend.RestoreBackup(ctx, pod, image)
+	observeBackend("RestoreBackup", start, err)
+	return err
+}
+
+func observeBackend(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	vsphereDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
 }
 
 // DebugHost is a host in the debug backend.
@@ -99,56 +330,129 @@ type DebugImage string
 // DebugBackend is a fake backend that can be used to test the Slack bot without interacting
 // with real hosts.
 //
-// A DebugBackend conceptually has a single fake host that is not checked out at process
-// start. Selecting a host always selects this host, and checking it in or out always succeeds.
+// A DebugBackend conceptually has a few fake hosts, none of which are checked out at process
+// start. Selecting a host selects the first one that isn't checked out, and checking hosts in
+// or out always succeeds. The pod name passed to each operation is ignored.
 type DebugBackend struct {
-	Host         DebugHost
-	isCheckedOut bool
+	Hosts        []DebugHost
 	disableSleep bool
+
+	mu            sync.Mutex
+	checkedOut    map[DebugHost]bool
+	deletedImages map[string]bool
+}
+
+// NewDebugBackend creates a debug backend with the given fake hosts.
+func NewDebugBackend(hosts ...DebugHost) *DebugBackend {
+	return &DebugBackend{
+		Hosts:         hosts,
+		checkedOut:    make(map[DebugHost]bool),
+		deletedImages: make(map[string]bool),
+	}
 }
 
-func (b *DebugBackend) IsHostCheckedOut(ctx context.Context) (bool, error) {
-	return b.isCheckedOut, nil
+func (b *DebugBackend) CheckedOutHosts(ctx context.Context, pod string) ([]Host, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var hosts []Host
+	for _, h := range b.Hosts {
+		if b.checkedOut[h] {
+			hosts = append(hosts, h)
+		}
+	}
+
+	return hosts, nil
 }
 
-func (b *DebugBackend) SelectHost(ctx context.Context) (Host, error) {
+func (b *DebugBackend) SelectHost(ctx context.Context, pod string) (Host, error) {
 	if !b.disableSleep {
 		time.Sleep(time.Second)
 	}
 
-	return b.Host, nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, h := range b.Hosts {
+		if !b.checkedOut[h] {
+			return h, nil
+		}
+	}
+
+	return nil, errors.New("no hosts are available to check out")
 }
 
-func (b *DebugBackend) CheckOutHost(ctx context.Context, h Host) error {
-	if !b.disableSleep {
-		time.Sleep(10 * time.Second)
+func (b *DebugBackend) CheckOutHost(ctx context.Context, pod string, h Host) error {
+	if err := b.sleep(ctx, 10*time.Second, "Moving host into dev cluster"); err != nil {
+		return err
 	}
 
-	b.isCheckedOut = true
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.checkedOut[h.(DebugHost)] = true
 	return nil
 }
 
-func (b *DebugBackend) CheckInHost(ctx context.Context) (Host, error) {
+func (b *DebugBackend) CheckInHost(ctx context.Context, pod string, h Host) error {
 	if !b.disableSleep {
 		time.Sleep(time.Second)
 	}
 
-	b.isCheckedOut = false
-	return b.Host, nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.checkedOut[h.(DebugHost)] = false
+	return nil
+}
+
+func (b *DebugBackend) BaseImages(ctx context.Context, pod string) ([]Image, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var images []Image
+	for _, name := range []string{"debug-base-image-3", "debug-base-image-1", "debug-base-image-2"} {
+		if !b.deletedImages[name] {
+			images = append(images, DebugImage(name))
+		}
+	}
+
+	return images, nil
 }
 
-func (b *DebugBackend) BaseImages(ctx context.Context) ([]Image, error) {
-	return []Image{
-		DebugImage("debug-base-image-3"),
-		DebugImage("debug-base-image-1"),
-		DebugImage("debug-base-image-2"),
-	}, nil
+func (b *DebugBackend) DeleteBaseImage(ctx context.Context, pod string, image string) error {
+	if err := b.sleep(ctx, 2*time.Second, "Deleting "+image); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deletedImages[image] = true
+	return nil
 }
 
-func (b *DebugBackend) RestoreBackup(ctx context.Context, image string) error {
-	if !b.disableSleep {
-		time.Sleep(10 * time.Second)
+func (b *DebugBackend) RestoreBackup(ctx context.Context, pod string, image string) error {
+	return b.sleep(ctx, 10*time.Second, "Cloning "+image)
+}
+
+// sleep pretends to run a slow vSphere task, reporting its progress along the way. It
+// stops early if the context is cancelled.
+func (b *DebugBackend) sleep(ctx context.Context, d time.Duration, detail string) error {
+	if b.disableSleep {
+		return ctx.Err()
 	}
+
+	const steps = 10
+	for i := 1; i <= steps; i++ {
+		select {
+		case <-time.After(d / steps):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		reportProgress(ctx, float32(i*100/steps), detail)
+	}
+
 	return nil
 }
 
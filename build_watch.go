@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+var buildWatches *BuildWatchStore
+
+// BuildWatch records an image build whose progress is being shown in a Slack message, so
+// that the bot can pick it up again if it restarts before the build finishes.
+type BuildWatch struct {
+	BuildID int64  `json:"build_id"`
+	Image   string `json:"image"`
+	Branch  string `json:"branch"`
+	User    string `json:"user"`
+	Channel string `json:"channel"`
+	Thread  string `json:"thread"`
+	Message string `json:"message"`
+}
+
+// BuildWatchStore keeps track of the image builds being watched.
+//
+// If the store has a path, the watches are saved to that file as JSON whenever they change,
+// so they survive the bot restarting.
+type BuildWatchStore struct {
+	path    string
+	mu      sync.Mutex
+	watches map[int64]BuildWatch
+}
+
+// NewBuildWatchStore creates a build watch store backed by the file at path, loading any
+// watches already saved there. An empty path creates a store that only lives in memory.
+func NewBuildWatchStore(path string) (*BuildWatchStore, error) {
+	s := &BuildWatchStore{
+		path:    path,
+		watches: make(map[int64]BuildWatch),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var watches []BuildWatch
+	if err := json.Unmarshal(data, &watches); err != nil {
+		return nil, err
+	}
+
+	for _, w := range watches {
+		s.watches[w.BuildID] = w
+	}
+
+	return s, nil
+}
+
+// Put adds or replaces the watch for a build.
+func (s *BuildWatchStore) Put(w BuildWatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watches[w.BuildID] = w
+	return s.save()
+}
+
+// Delete removes the watch for a build, if there is one.
+func (s *BuildWatchStore) Delete(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.watches, id)
+	return s.save()
+}
+
+// All returns every watch, oldest build first.
+func (s *BuildWatchStore) All() []BuildWatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watches := make([]BuildWatch, 0, len(s.watches))
+	for _, w := range s.watches {
+		watches = append(watches, w)
+	}
+
+	sort.Slice(watches, func(i, j int) bool {
+		return watches[i].BuildID < watches[j].BuildID
+	})
+	return watches
+}
+
+// save writes the watches to the store's file. The caller must hold the lock.
+func (s *BuildWatchStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	watches := make([]BuildWatch, 0, len(s.watches))
+	for _, w := range s.watches {
+		watches = append(watches, w)
+	}
+
+	data, err := json.MarshalIndent(watches, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// resumeBuildWatches goes back to watching the builds that were in progress when the bot
+// last stopped, updating their existing messages.
+func resumeBuildWatches(ctx context.Context) {
+	for _, w := range buildWatches.All() {
+		log.WithFields(log.Fields{
+			"build": w.BuildID,
+			"image": w.Image,
+			"user":  w.User,
+		}).Info("resuming build watch")
+
+		conv := NewThreadConversation(w.User, w.Channel, w.Thread)
+		msg := ReplyTo(conv).
+			AttachText("Building %s image for <@%s>…", w.Image, w.User).
+			Timestamp(w.Message).
+			InThread()
+
+		go watchBuild(ctx, conv, msg, w)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/imaged/rpc/images"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeImages is an imaged client that starts build 7, and returns a build with each of the
+// given statuses in turn, staying on the last one.
+type fakeImages struct {
+	images.Images
+	statuses []images.Build_Status
+}
+
+func (f *fakeImages) StartBuild(ctx context.Context, req *images.StartBuildRequest) (*images.StartBuildResponse, error) {
+	return &images.StartBuildResponse{
+		Build: &images.Build{
+			Id:       7,
+			Name:     req.Name,
+			Revision: req.Revision,
+			Status:   images.Build_CREATED,
+		},
+	}, nil
+}
+
+func (f *fakeImages) GetBuild(ctx context.Context, req *images.GetBuildRequest) (*images.GetBuildResponse, error) {
+	status := f.statuses[0]
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+
+	return &images.GetBuildResponse{
+		Build: &images.Build{
+			Id:       req.Id,
+			Name:     "high-sierra",
+			Revision: "master",
+			Status:   status,
+		},
+	}, nil
+}
+
+func (f *fakeImages) GetRecordURL(ctx context.Context, req *images.GetRecordURLRequest) (*images.GetRecordURLResponse, error) {
+	return &images.GetRecordURLResponse{Url: "https://example.com/build.log"}, nil
+}
+
+func TestBuildWatchStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macbot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "builds.json")
+	store, err := NewBuildWatchStore(path)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(BuildWatch{BuildID: 2, Image: "mojave", User: "other"}))
+	require.NoError(t, store.Put(BuildWatch{BuildID: 1, Image: "high-sierra", User: "user", Message: "123.456"}))
+	require.NoError(t, store.Delete(2))
+
+	store, err = NewBuildWatchStore(path)
+	require.NoError(t, err)
+	require.Equal(t, []BuildWatch{{BuildID: 1, Image: "high-sierra", User: "user", Message: "123.456"}}, store.All())
+}
+
+func TestWatchBuildResumed(t *testing.T) {
+	imagesClient = &fakeImages{statuses: []images.Build_Status{images.Build_STARTED, images.Build_SUCCEEDED}}
+	buildPollInterval = time.Millisecond
+	buildWatches, _ = NewBuildWatchStore("")
+
+	w := BuildWatch{BuildID: 7, Image: "high-sierra", Branch: "master", User: "user", Message: "42"}
+	require.NoError(t, buildWatches.Put(w))
+
+	conv := newTestConversation("")
+	msg := ReplyTo(conv).AttachText("Building high-sierra image for <@user>…").Timestamp(w.Message).InThread()
+	watchBuild(context.TODO(), conv, msg, w)
+
+	require.Len(t, conv.replies, 3)
+
+	// The existing message is edited rather than a new one being sent
+	require.Equal(t, "42", conv.replies[0].timestamp)
+	require.Equal(t, messageField{title: "Status", value: "Building", short: true}, conv.replies[0].fields[1])
+	require.NotEmpty(t, conv.replies[1].timestamp)
+	require.Equal(t, "good", conv.replies[1].color)
+
+	reply := conv.replies[2]
+	require.Equal(t, "", reply.timestamp)
+	require.Equal(t, "Successfully built high-sierra image for <@user>", reply.text)
+	require.True(t, reply.broadcast)
+
+	require.Empty(t, buildWatches.All())
+}
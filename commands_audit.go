@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"strings"
+	"time"
+)
+
+// defaultAuditPeriod is how far back the audit log is searched if the user doesn't say.
+const defaultAuditPeriod = 24 * time.Hour
+
+// maxAuditEntries is the most audit log entries shown in one reply.
+const maxAuditEntries = 20
+
+// AuditLogEntries shows recent commands from the audit log, optionally only for one user.
+func AuditLogEntries(ctx context.Context, conv Conversation) {
+	user := slackUserID(conv.String("user"))
+
+	period := defaultAuditPeriod
+	if s := conv.String("duration"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			ReplyTo(conv).ErrorText("I don't understand how long `%s` is. Try something like `24h` or `90m`.", s).Send()
+			return
+		}
+		period = d
+	}
+
+	entries, err := auditLog.Search(user, time.Now().Add(-period))
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't read the audit log.").Error(err).Send()
+		return
+	}
+
+	who := "anyone"
+	if user != "" {
+		who = fmt.Sprintf("<@%s>", user)
+	}
+
+	if len(entries) == 0 {
+		ReplyTo(conv).Text("No commands were run by %s in the last %s.", who, period).Send()
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Commands run by %s in the last %s:\n", who, period)
+	for i, e := range entries {
+		if i == maxAuditEntries {
+			fmt.Fprintf(&b, "\n…and %d more.", len(entries)-maxAuditEntries)
+			break
+		}
+
+		fmt.Fprintf(&b, "\n• `%s` by <@%s> in <#%s> %s: *%s*", e.Command, e.User, e.Channel, humanize.Time(e.StartedAt), e.Result)
+	}
+
+	ReplyTo(conv).Text(b.String()).Send()
+}
+
+// slackUserID extracts a user ID from a Slack mention like <@U012AB3CD> or
+// <@U012AB3CD|someone>. Command text is lowercased, so the ID is put back in upper case.
+// Anything else is returned as is.
+func slackUserID(s string) string {
+	if !strings.HasPrefix(s, "<@") || !strings.HasSuffix(s, ">") {
+		return s
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(s, "<@"), ">")
+	if i := strings.Index(id, "|"); i >= 0 {
+		id = id[:i]
+	}
+	return strings.ToUpper(id)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultKeepUnusedBaseImages is how many unused base VMs of each template are kept if the
+// pod's config doesn't say.
+const defaultKeepUnusedBaseImages = 2
+
+// keepUnusedBaseImages is how many of the newest unused base VMs of each template are kept
+// in each pod when unused base VMs are deleted.
+var keepUnusedBaseImages map[string]int
+
+// baseImage is a base VM, with the template and time the name says it was made from.
+type baseImage struct {
+	Name     string
+	Template string
+	// MadeAt is the zero time if the name doesn't end in a timestamp.
+	MadeAt time.Time
+}
+
+// UnusedBaseImages lists the base VMs in a pod that aren't registered in any job board, and
+// how old they are.
+func UnusedBaseImages(ctx context.Context, conv Conversation) {
+	pod := podName(conv)
+
+	unused, ok := loadUnusedBaseImages(ctx, conv, pod)
+	if !ok {
+		return
+	}
+
+	if len(unused) == 0 {
+		ReplyTo(conv).Text("Every base VM in %s is registered in a job board.", pod).Send()
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Base VMs in %s that aren't registered in any job board:\n", pod)
+	for _, i := range unused {
+		fmt.Fprintf(&b, "\n• `%s` %s", i.Name, describeBaseImageAge(i))
+	}
+
+	ReplyTo(conv).Text(b.String()).Send()
+}
+
+func describeBaseImageAge(i baseImage) string {
+	if i.MadeAt.IsZero() {
+		return "(unknown age)"
+	}
+
+	return "made " + humanize.Time(i.MadeAt)
+}
+
+// DeleteUnusedBaseImages deletes the base VMs in a pod that aren't registered in any job
+// board and are older than the given age. The newest unused VMs of each template are kept,
+// so that there is still something to roll back to, and so are VMs whose names don't say
+// how old they are.
+//
+// The user has to confirm before anything is deleted.
+func DeleteUnusedBaseImages(ctx context.Context, conv Conversation) {
+	pod := podName(conv)
+
+	age, ok := parseAge(conv.String("age"))
+	if !ok {
+		ReplyTo(conv).ErrorText("I don't understand how old `%s` is. Try something like `30d` or `720h`.", conv.String("age")).Send()
+		return
+	}
+
+	unused, ok := loadUnusedBaseImages(ctx, conv, pod)
+	if !ok {
+		return
+	}
+
+	stale := staleBaseImages(unused, unusedBaseImagesToKeep(pod), time.Now().Add(-age))
+	if len(stale) == 0 {
+		ReplyTo(conv).Text("There are no unused base VMs older than %s in %s to delete.", conv.String("age"), pod).Send()
+		return
+	}
+
+	var list strings.Builder
+	for _, i := range stale {
+		fmt.Fprintf(&list, "• `%s` %s\n", i.Name, describeBaseImageAge(i))
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("<@%s>, are you sure you want to delete these base VMs? They aren't registered in any job board, but they can't be brought back.", conv.User()).
+		Field("Base VMs", "%s", strings.TrimSpace(list.String())).
+		ShortField("Pod", pod).
+		ShortField("Kept", "The %d newest of each template", unusedBaseImagesToKeep(pod))
+
+	Confirm(conv, msg, func(ctx context.Context) {
+		deleteBaseImages(ctx, conv, pod, stale)
+	})
+}
+
+func deleteBaseImages(ctx context.Context, conv Conversation, pod string, images []baseImage) {
+	ctx, op, done := operations.Start(ctx, conv, fmt.Sprintf("delete %d unused base VMs in %s", len(images), pod))
+	defer done()
+
+	msg := ReplyTo(conv).
+		AttachText("Deleting unused base VMs for <@%s>…", conv.User()).
+		ShortField("Pod", pod).
+		ShortField("Deleted", "0 of %d", len(images)).
+		Footer(fmt.Sprintf("Operation %d", op.ID), op.StartedAt).
+		InThread().
+		Send()
+
+	// Someone might have registered one of them since the user confirmed
+	registered, ok := loadRegisteredImages(ctx, conv)
+	if !ok {
+		return
+	}
+
+	var deleted, skipped []string
+	for _, i := range images {
+		if registered[i.Name] {
+			skipped = append(skipped, i.Name)
+			continue
+		}
+
+		if err := backend.DeleteBaseImage(TrackProgress(ctx, msg), pod, i.Name); err != nil {
+			if op.reportCancelled(msg) {
+				return
+			}
+			ReplyTo(conv).ErrorText("I couldn't delete the base VM `%s`, so I stopped. I had deleted %d before that.", i.Name, len(deleted)).Error(err).Broadcast().Send()
+			return
+		}
+
+		deleted = append(deleted, i.Name)
+		msg.ReplaceField("Deleted", "%d of %d", len(deleted), len(images)).Send()
+	}
+
+	reply := ReplyTo(conv).
+		AttachText("Successfully deleted %d unused base VMs for <@%s>!", len(deleted), conv.User()).
+		Color("good").
+		ShortField("Pod", pod)
+	if len(skipped) > 0 {
+		reply.Field("Skipped", "`%s` became registered in a job board, so I kept it.", strings.Join(skipped, "`, `"))
+	}
+	reply.Broadcast().Send()
+}
+
+// loadUnusedBaseImages lists the base VMs in a pod that aren't registered in any job board,
+// oldest first, followed by the ones whose age isn't known. If the VMs or images can't be
+// listed, it tells the user and returns false.
+func loadUnusedBaseImages(ctx context.Context, conv Conversation, pod string) ([]baseImage, bool) {
+	vms, err := backend.BaseImages(ctx, pod)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't get the list of base images.").Error(err).Send()
+		return nil, false
+	}
+
+	registered, ok := loadRegisteredImages(ctx, conv)
+	if !ok {
+		return nil, false
+	}
+
+	var unused []baseImage
+	for _, vm := range vms {
+		if !registered[vm.Name()] {
+			unused = append(unused, newBaseImage(vm))
+		}
+	}
+
+	// Compare the parsed times, since timestamps of different lengths don't sort as strings
+	sort.SliceStable(unused, func(a, b int) bool {
+		if unused[a].MadeAt.IsZero() || unused[b].MadeAt.IsZero() {
+			return !unused[a].MadeAt.IsZero() && unused[b].MadeAt.IsZero()
+		}
+		return unused[a].MadeAt.Before(unused[b].MadeAt)
+	})
+	return unused, true
+}
+
+// loadRegisteredImages returns the names of the images registered in every job board
+// environment, on the configured infra and on every other infra the tag history says images
+// were registered on. Since a base VM that's missing from one of them could still be in use,
+// it tells the user and returns false if any of them can't be listed.
+func loadRegisteredImages(ctx context.Context, conv Conversation) (map[string]bool, bool) {
+	if len(jobBoards) == 0 {
+		ReplyTo(conv).ErrorText("No job boards are configured, so I can't tell which base VMs are in use.").Send()
+		return nil, false
+	}
+
+	envs := make([]string, 0, len(jobBoards))
+	for env := range jobBoards {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	registered := make(map[string]bool)
+	for _, env := range envs {
+		infras, err := tagHistory.Infras(env)
+		if err != nil {
+			ReplyTo(conv).ErrorText("I couldn't read the tag history, so I can't tell which infras have images registered in job-board-%s.", env).Error(err).Send()
+			return nil, false
+		}
+
+		boards := []*JobBoard{jobBoards[env]}
+		for _, infra := range infras {
+			if infra != jobBoards[env].Infra {
+				boards = append(boards, jobBoards[env].OnInfra(infra))
+			}
+		}
+
+		for _, jb := range boards {
+			images, err := jb.ListImages(ctx)
+			if err != nil {
+				ReplyTo(conv).ErrorText("I couldn't get the list of images on %s from job-board-%s, so I can't tell which base VMs are in use.", jb.Infra, env).Error(err).Send()
+				return nil, false
+			}
+
+			for _, i := range images {
+				registered[i.Name] = true
+			}
+		}
+	}
+
+	return registered, true
+}
+
+func newBaseImage(vm Image) baseImage {
+	i := baseImage{Name: vm.Name()}
+	if dash := strings.LastIndex(i.Name, "-"); dash >= 0 {
+		i.Template = i.Name[:dash]
+	}
+
+	if ts, err := strconv.ParseInt(extractTimestamp(vm), 10, 64); err == nil {
+		i.MadeAt = time.Unix(ts, 0)
+	}
+
+	return i
+}
+
+// staleBaseImages picks the unused base VMs that were made before cutoff, leaving out the
+// newest keep VMs of each template and any VMs whose age isn't known.
+func staleBaseImages(unused []baseImage, keep int, cutoff time.Time) []baseImage {
+	byTemplate := make(map[string][]baseImage)
+	for _, i := range unused {
+		if !i.MadeAt.IsZero() {
+			byTemplate[i.Template] = append(byTemplate[i.Template], i)
+		}
+	}
+
+	var stale []baseImage
+	for _, images := range byTemplate {
+		sort.Slice(images, func(a, b int) bool {
+			return images[a].MadeAt.After(images[b].MadeAt)
+		})
+
+		for n, i := range images {
+			if n >= keep && i.MadeAt.Before(cutoff) {
+				stale = append(stale, i)
+			}
+		}
+	}
+
+	sort.Slice(stale, func(a, b int) bool {
+		return stale[a].MadeAt.Before(stale[b].MadeAt)
+	})
+	return stale
+}
+
+func unusedBaseImagesToKeep(pod string) int {
+	if keep, found := keepUnusedBaseImages[pod]; found {
+		return keep
+	}
+
+	return defaultKeepUnusedBaseImages
+}
+
+// parseAge parses an age like `720h`, or a number of days like `30d`, which Go durations
+// don't support.
+func parseAge(s string) (time.Duration, bool) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, false
+		}
+		return time.Duration(days) * 24 * time.Hour, true
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var testBaseImages = []string{
+	"xcode10-1000",
+	"xcode10-1200",
+	"xcode10-1300",
+	"xcode10-1400",
+	"xcode10-1500",
+	"xcode10-2000",
+	"sierra-900",
+	"custom",
+}
+
+func TestUnusedBaseImages(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages(testBaseImages...)
+
+	conv := newTestConversation("unused base images")
+	UnusedBaseImages(context.TODO(), conv)
+
+	require.Equal(t, "<@user>: Base VMs in pod-1 that aren't registered in any job board:\n"+
+		"\n• `sierra-900` made a long while ago"+
+		"\n• `xcode10-1000` made a long while ago"+
+		"\n• `xcode10-1200` made a long while ago"+
+		"\n• `xcode10-1300` made a long while ago"+
+		"\n• `xcode10-1400` made a long while ago"+
+		"\n• `custom` (unknown age)", conv.replies[0].text)
+}
+
+func TestUnusedBaseImagesChecksOtherInfras(t *testing.T) {
+	jb, done := newTestFakeJobBoard()
+	defer done()
+	jobBoards = map[string]*JobBoard{"production": jb}
+	defer func() { jobBoards = nil }()
+	tagHistory = NewTagHistory("")
+	defer func() { tagHistory = nil }()
+	setupBaseImages("xcode10-1000", "xcode10-2000")
+
+	ctx := context.TODO()
+	require.NoError(t, registerTag(ctx, jb, "production", "xcode10-2000", "xcode10", "user", ""))
+	require.NoError(t, registerTag(ctx, jb.OnInfra("gce"), "production", "xcode10-1000", "xcode10", "user", ""))
+
+	conv := newTestConversation("unused base images")
+	UnusedBaseImages(ctx, conv)
+	require.Equal(t, "<@user>: Every base VM in pod-1 is registered in a job board.", conv.replies[0].text)
+}
+
+func TestUnusedBaseImagesNeedsEveryJobBoard(t *testing.T) {
+	jb, _, done := testJobBoard(testResponse{401, ""})
+	defer done()
+	jobBoards = map[string]*JobBoard{"staging": jb}
+	defer func() { jobBoards = nil }()
+	setupBaseImages(testBaseImages...)
+
+	conv := newTestConversation("unused base images")
+	UnusedBaseImages(context.TODO(), conv)
+	require.Equal(t, "Sorry, <@user>! I couldn't get the list of images on jupiterbrain from job-board-staging, so I can't tell which base VMs are in use.", conv.replies[0].text)
+
+	jobBoards = nil
+	conv = newTestConversation("unused base images")
+	UnusedBaseImages(context.TODO(), conv)
+	require.Equal(t, "Sorry, <@user>! No job boards are configured, so I can't tell which base VMs are in use.", conv.replies[0].text)
+}
+
+func TestUnusedBaseImagesCommands(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages(testBaseImages...)
+	confirmations = NewConfirmations(time.Hour)
+
+	router := NewRouter()
+	addCommands(router)
+
+	conv := newTestConversation("unused base vms in pod-1")
+	router.Reply(context.TODO(), conv)
+	require.Contains(t, conv.replies[0].text, "Base VMs in pod-1 that aren't registered in any job board:")
+
+	conv = newTestConversation("delete unused base images older than 30d")
+	router.Reply(context.TODO(), conv)
+	require.Contains(t, conv.replies[0].text, "<@user>, are you sure you want to delete these base VMs?")
+}
+
+func deleteUnusedBaseImagesForTest(age string) *testConversation {
+	conv := newTestConversation("delete unused base images older than " + age)
+	conv.SetProperties(proper.NewProperties(map[string]string{"age": age}))
+	DeleteUnusedBaseImages(context.TODO(), conv)
+	return conv
+}
+
+func TestDeleteUnusedBaseImages(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages(testBaseImages...)
+	confirmations = NewConfirmations(time.Hour)
+
+	conv := deleteUnusedBaseImagesForTest("30d")
+	require.Contains(t, conv.replies[0].text, "<@user>, are you sure you want to delete these base VMs?")
+	require.Equal(t, messageField{title: "Base VMs", value: "• `xcode10-1000` made a long while ago\n• `xcode10-1200` made a long while ago"}, conv.replies[0].fields[0])
+
+	b := backend.(baseImagesBackend)
+	require.Empty(t, b.deletedImages)
+
+	clickButton(conv, "user", "confirm")
+	require.Equal(t, map[string]bool{"xcode10-1000": true, "xcode10-1200": true}, b.deletedImages)
+
+	reply := conv.replies[len(conv.replies)-1]
+	require.Equal(t, "Successfully deleted 2 unused base VMs for <@user>!", reply.text)
+	require.True(t, reply.broadcast)
+}
+
+func TestDeleteUnusedBaseImagesNothingToDelete(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages("xcode10-1500", "xcode10-1600", "xcode10-1700")
+	keepUnusedBaseImages = map[string]int{"pod-1": 2}
+	defer func() { keepUnusedBaseImages = nil }()
+
+	conv := deleteUnusedBaseImagesForTest("720h")
+	require.Equal(t, "<@user>: There are no unused base VMs older than 720h in pod-1 to delete.", conv.replies[0].text)
+
+	conv = deleteUnusedBaseImagesForTest("soon")
+	require.Equal(t, "Sorry, <@user>! I don't understand how old `soon` is. Try something like `30d` or `720h`.", conv.replies[0].text)
+}
+
+func TestStaleBaseImages(t *testing.T) {
+	var unused []baseImage
+	for _, name := range []string{"a-100", "a-200", "a-300", "b-100", "c"} {
+		unused = append(unused, newBaseImage(DebugImage(name)))
+	}
+
+	stale := staleBaseImages(unused, 1, time.Unix(250, 0))
+	require.Len(t, stale, 2)
+	require.Equal(t, "a-100", stale[0].Name)
+	require.Equal(t, "a-200", stale[1].Name)
+
+	require.Empty(t, staleBaseImages(unused, 0, time.Unix(50, 0)))
+	require.Len(t, staleBaseImages(unused, 0, time.Unix(1000, 0)), 4)
+}
+
+func TestParseAge(t *testing.T) {
+	d, ok := parseAge("30d")
+	require.True(t, ok)
+	require.Equal(t, 30*24*time.Hour, d)
+
+	d, ok = parseAge("90m")
+	require.True(t, ok)
+	require.Equal(t, 90*time.Minute, d)
+
+	for _, s := range []string{"", "d", "-1d", "0h", "week"} {
+		_, ok = parseAge(s)
+		require.False(t, ok, s)
+	}
+}
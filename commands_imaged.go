@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/dustin/go-humanize"
 	log "github.com/sirupsen/logrus"
 	"github.com/travis-ci/imaged/rpc/images"
 	"time"
 )
 
+// buildPollInterval is how often builds are checked on while they're being watched.
+var buildPollInterval = 5 * time.Second
+
 // LastImageBuild shows information about the most recent build of an image template.
 func LastImageBuild(ctx context.Context, conv Conversation) {
 	image := conv.String("image")
@@ -52,39 +56,96 @@ func BuildImage(ctx context.Context, conv Conversation) {
 	build := resp.Build
 
 	msg := ReplyTo(conv).
-		AttachText("Building %s image for <@%s>…", build.Name, conv.User())
+		AttachText("Building %s image for <@%s>…", build.Name, conv.User()).
+		InThread()
 	updateMessage(msg, build)
 	msg.Send()
 
-	// Check on the build every few seconds and update the Slack message
-	for {
-		r, err := imagesClient.GetBuild(ctx, &images.GetBuildRequest{Id: build.Id})
-		if err != nil {
-			log.Printf("failed to get build info while watching build: %v", err)
-		} else {
-			build = r.Build
-			if buildFinished(build) {
-				break
-			}
+	w := BuildWatch{
+		BuildID: build.Id,
+		Image:   build.Name,
+		Branch:  branch,
+		User:    conv.User(),
+		Channel: conv.Channel(),
+		Thread:  conv.ThreadTimestamp(),
+		Message: msg.timestamp,
+	}
+	if err := buildWatches.Put(w); err != nil {
+		log.WithError(err).WithField("build", build.Id).Error("could not save build watch")
+	}
+
+	watchBuild(ctx, conv, msg, w)
+}
+
+// watchBuild checks on a build every few seconds and updates its Slack message, until the
+// build finishes or someone cancels watching it. When the build finishes, a new message is
+// sent to notify the user who started it.
+func watchBuild(ctx context.Context, conv Conversation, msg *MessageBuilder, w BuildWatch) {
+	ctx, op, done := operations.StartResumable(ctx, conv, fmt.Sprintf("build image %s at %s", w.Image, w.Branch))
+	defer done()
+
+	entry := log.WithField("build", w.BuildID)
+	msg.Footer(fmt.Sprintf("Operation %d", op.ID), op.StartedAt)
 
-			updateMessage(msg, build)
-			msg.Send()
+	build, err := pollBuild(ctx, w.BuildID, func(b *images.Build) {
+		updateMessage(msg, b)
+		msg.Send()
+	})
+	if err != nil {
+		if op.CancelledBy() == "" {
+			// The bot is stopping, so leave the watch to be resumed when it starts again
+			return
 		}
 
-		time.Sleep(5 * time.Second)
+		// imaged has no way to cancel a build that has started, so all we can do is stop
+		// watching it
+		msg.AttachText("Stopped watching the %s image build for <@%s>. It will keep running in imaged until it finishes.", w.Image, w.User)
+		op.reportCancelled(msg)
+		if err := buildWatches.Delete(w.BuildID); err != nil {
+			entry.WithError(err).Error("could not delete build watch")
+		}
+		return
+	}
+
+	if err := buildWatches.Delete(w.BuildID); err != nil {
+		entry.WithError(err).Error("could not delete build watch")
 	}
 
 	// Send new message when build completes to trigger a notification
-	msg = ReplyTo(conv)
+	msg = ReplyTo(conv).Broadcast()
 	if build.Status == images.Build_SUCCEEDED {
-		msg.AttachText("Successfully built %s image for <@%s>", build.Name, conv.User())
+		msg.AttachText("Successfully built %s image for <@%s>", build.Name, w.User)
 	} else {
-		msg.AttachText("Failed to build %s image for <@%s>", build.Name, conv.User())
+		msg.AttachText("Failed to build %s image for <@%s>", build.Name, w.User)
 	}
 	updateMessage(msg, build)
 	msg.Send()
 }
 
+// pollBuild checks on a build every few seconds, passing it to update each time, until the
+// build finishes or the context is done. Failures to get the build are logged and retried.
+func pollBuild(ctx context.Context, id int64, update func(*images.Build)) (*images.Build, error) {
+	entry := log.WithField("build", id)
+
+	for {
+		r, err := imagesClient.GetBuild(ctx, &images.GetBuildRequest{Id: id})
+		if err != nil {
+			entry.WithError(err).Error("failed to get build info while watching build")
+		} else {
+			update(r.Build)
+			if buildFinished(r.Build) {
+				return r.Build, nil
+			}
+		}
+
+		select {
+		case <-time.After(buildPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 func buildFinished(b *images.Build) bool {
 	return b.Status == images.Build_SUCCEEDED || b.Status == images.Build_FAILED
 }
@@ -155,3 +216,44 @@ func updateMessage(msg *MessageBuilder, b *images.Build) {
 		msg.Color("")
 	}
 }
+
+// instrumentedImages is an imaged client that keeps track of how long its requests take and
+// whether they fail.
+type instrumentedImages struct {
+	images.Images
+}
+
+func (c instrumentedImages) GetLastBuild(ctx context.Context, req *images.GetLastBuildRequest) (*images.GetLastBuildResponse, error) {
+	start := time.Now()
+	resp, err := c.Images.GetLastBuild(ctx, req)
+	observeImaged("GetLastBuild", start, err)
+	return resp, err
+}
+
+func (c instrumentedImages) StartBuild(ctx context.Context, req *images.StartBuildRequest) (*images.StartBuildResponse, error) {
+	start := time.Now()
+	resp, err := c.Images.StartBuild(ctx, req)
+	observeImaged("StartBuild", start, err)
+	return resp, err
+}
+
+func (c instrumentedImages) GetBuild(ctx context.Context, req *images.GetBuildRequest) (*images.GetBuildResponse, error) {
+	start := time.Now()
+	resp, err := c.Images.GetBuild(ctx, req)
+	observeImaged("GetBuild", start, err)
+	return resp, err
+}
+
+func (c instrumentedImages) GetRecordURL(ctx context.Context, req *images.GetRecordURLRequest) (*images.GetRecordURLResponse, error) {
+	start := time.Now()
+	resp, err := c.Images.GetRecordURL(ctx, req)
+	observeImaged("GetRecordURL", start, err)
+	return resp, err
+}
+
+func observeImaged(method string, start time.Time, err error) {
+	imagedDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		imagedErrors.WithLabelValues(method).Inc()
+	}
+}
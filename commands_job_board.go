@@ -3,38 +3,108 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/dustin/go-humanize"
+	"sort"
 	"strings"
 )
 
-// ListImages lists the images registered in job board.
+// ListImages lists the images registered in job board, with all of their tags.
 func ListImages(ctx context.Context, conv Conversation) {
 	env := conv.String("env")
 	if env == "" {
 		env = "production"
 	}
 
-	jb, found := jobBoards[env]
-	if !found {
-		ReplyTo(conv).ErrorText("No job board is configured for the %s environment.", env).Send()
+	jb, ok := jobBoardFor(conv, env)
+	if !ok {
 		return
 	}
 
 	images, err := jb.ListImages(ctx)
 	if err != nil {
 		ReplyTo(conv).ErrorText("I couldn't get the list of images from job board.").Error(err).Send()
+		return
 	}
 
 	var b strings.Builder
-	fmt.Fprintf(&b, "macOS images registered in job-board-%s:\n", env)
+	fmt.Fprintf(&b, "macOS images registered in job-board-%s on %s:\n", env, jb.Infra)
 	for _, i := range images {
-		fmt.Fprintf(&b, "\n*%s*: `%s`", i.Tag, i.Name)
+		fmt.Fprintf(&b, "\n• `%s`", i.Name)
+		if i.IsDefault {
+			b.WriteString(" (default)")
+		}
+		fmt.Fprintf(&b, ": %s.", describeTags(i.Tags))
+
+		if !i.CreatedAt.IsZero() {
+			fmt.Fprintf(&b, " Registered %s", humanize.Time(i.CreatedAt))
+			if i.UpdatedAt.After(i.CreatedAt) {
+				fmt.Fprintf(&b, ", updated %s", humanize.Time(i.UpdatedAt))
+			}
+			b.WriteString(".")
+		}
 	}
 
 	ReplyTo(conv).Text(b.String()).Send()
 }
 
+// describeTags lists an image's tags for a message, sorted by key.
+func describeTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return "no tags"
+	}
+
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, fmt.Sprintf("`%s:%s`", k, v))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// jobBoardFor returns the job board client for an environment, managing the infra the user
+// named or the environment's usual one. If no job board is configured for the environment,
+// it tells the user and returns false.
+func jobBoardFor(conv Conversation, env string) (*JobBoard, bool) {
+	jb, found := jobBoards[env]
+	if !found {
+		ReplyTo(conv).ErrorText("No job board is configured for the %s environment.", env).Send()
+		return nil, false
+	}
+
+	if infra := conv.String("infra"); infra != "" {
+		jb = jb.OnInfra(infra)
+	}
+	return jb, true
+}
+
+// requireApproval lists the job board environments where changes need to be approved by
+// a second person before they are made.
+var requireApproval map[string]bool
+
+// jobBoardPods lists the pod whose base VMs are registered in each job board environment.
+// Environments that aren't listed use the default pod.
+var jobBoardPods map[string]string
+
 // RegisterImage adds the image to job board as a macOS build image.
+//
+// The image has to be one of the base VMs in the environment's pod, so that a typo doesn't
+// leave builds unable to boot. If the tag already points to another image, the user is
+// told which one it replaces and has to confirm.
+//
+// In environments that require approval, the image is only registered once someone else
+// approves the request.
 func RegisterImage(ctx context.Context, conv Conversation) {
+	registerImageCommand(ctx, conv, false)
+}
+
+// ForceRegisterImage registers an image like RegisterImage, without checking that it's one
+// of the base VMs in the pod.
+func ForceRegisterImage(ctx context.Context, conv Conversation) {
+	registerImageCommand(ctx, conv, true)
+}
+
+func registerImageCommand(ctx context.Context, conv Conversation, force bool) {
 	image := conv.String("image")
 	tag := conv.String("tag")
 	env := conv.String("env")
@@ -42,28 +112,186 @@ func RegisterImage(ctx context.Context, conv Conversation) {
 		env = "production"
 	}
 
-	jb, found := jobBoards[env]
-	if !found {
-		ReplyTo(conv).ErrorText("No job board is configured for the %s environment.", env).Send()
+	jb, ok := jobBoardFor(conv, env)
+	if !ok {
 		return
 	}
 
-	err := jb.RegisterImage(ctx, image, tag)
+	pod := jobBoardPod(env)
+	if !force && !checkBaseImage(ctx, conv, pod, image) {
+		return
+	}
+
+	images, err := jb.ListImages(ctx)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't get the list of images on %s from job-board-%s, so I can't tell what `%s` points to now. I didn't register it.", jb.Infra, env, tag).Error(err).Send()
+		return
+	}
+
+	var replaced string
+	if old := taggedImage(images, tag); old != image {
+		replaced = old
+	}
+
+	if !requireApproval[env] {
+		if replaced == "" {
+			registerImage(ctx, conv, jb, env, image, tag, "")
+			return
+		}
+
+		msg := ReplyTo(conv).
+			AttachText("<@%s>, `%s` already points to `%s` in job-board-%s. Are you sure you want to replace it?", conv.User(), tag, replaced, env).
+			Field("Image", image).
+			ShortField("Tag", tag).
+			ShortField("Environment", env).
+			ShortField("Infra", jb.Infra)
+		Confirm(conv, msg, func(ctx context.Context) {
+			registerImage(ctx, conv, jb, env, image, tag, "")
+		})
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("<@%s> wants to register an image in job-board-%s.", conv.User(), env).
+		Field("Image", image).
+		ShortField("Tag", tag).
+		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+	if replaced != "" {
+		msg.Field("Replaces", "`%s`", replaced)
+	}
+	if force {
+		msg.Field("Warning", ":warning: Not checked against the base VMs in %s", pod)
+	}
+
+	RequestApproval(conv, msg, roleReleaser, func(ctx context.Context, approver string) {
+		registerImage(ctx, conv, jb, env, image, tag, approver)
+	})
+}
+
+// jobBoardPod returns the pod whose base VMs are registered in a job board environment.
+func jobBoardPod(env string) string {
+	if pod, found := jobBoardPods[env]; found {
+		return pod
+	}
+
+	return defaultPod
+}
+
+// checkBaseImage makes sure an image is one of the base VMs in a pod. If it isn't, it tells
+// the user which base VMs have similar names and returns false.
+func checkBaseImage(ctx context.Context, conv Conversation, pod string, image string) bool {
+	vms, err := backend.BaseImages(ctx, pod)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't get the list of base images in %s to check the image name. Use `force register image` to register it anyway.", pod).Error(err).Send()
+		return false
+	}
+
+	names := make([]string, len(vms))
+	for i, vm := range vms {
+		if vm.Name() == image {
+			return true
+		}
+		names[i] = vm.Name()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "There's no base VM named `%s` in %s, so I didn't register it.", image, pod)
+	if matches := closeMatches(image, names); len(matches) > 0 {
+		fmt.Fprintf(&b, " Did you mean `%s`?", strings.Join(matches, "` or `"))
+	}
+	b.WriteString(" Use `force register image` if you're sure.")
+
+	ReplyTo(conv).ErrorText("%s", b.String()).Send()
+	return false
+}
+
+// maxCloseMatches is the most similar names suggested when a name isn't found.
+const maxCloseMatches = 3
+
+// closeMatches returns the candidates that are only a few edits away from name, closest
+// first.
+func closeMatches(name string, candidates []string) []string {
+	// Allow roughly one typo for every four characters, so short names don't match everything
+	limit := len(name) / 4
+	if limit < 2 {
+		limit = 2
+	}
+
+	distances := make(map[string]int)
+	var matches []string
+	for _, c := range candidates {
+		if d := editDistance(name, c); d <= limit {
+			distances[c] = d
+			matches = append(matches, c)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return distances[matches[i]] < distances[matches[j]]
+	})
+	if len(matches) > maxCloseMatches {
+		matches = matches[:maxCloseMatches]
+	}
+	return matches
+}
+
+// editDistance is the Levenshtein distance between two strings: how many characters have
+// to be inserted, deleted or replaced to turn one into the other.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func registerImage(ctx context.Context, conv Conversation, jb *JobBoard, env string, image string, tag string, approver string) {
+	err := registerTag(ctx, jb, env, image, tag, conv.User(), approver)
 	if err != nil {
 		ReplyTo(conv).ErrorText("I couldn't register the image with job board.").Error(err).Send()
 		return
 	}
 
-	ReplyTo(conv).
+	msg := ReplyTo(conv).
 		AttachText("Successfully registered image for <@%s>", conv.User()).
 		Color("good").
 		Field("Image", image).
 		ShortField("Tag", tag).
 		ShortField("Environment", env).
-		Send()
+		ShortField("Infra", jb.Infra)
+	addApprovalFields(msg, conv, approver)
+	msg.Send()
 }
 
 // UnregisterImage removes an image from job board.
+//
+// The user has to confirm before the image is removed. In environments that require
+// approval, someone else has to approve the request instead.
 func UnregisterImage(ctx context.Context, conv Conversation) {
 	image := conv.String("image")
 	env := conv.String("env")
@@ -71,21 +299,305 @@ func UnregisterImage(ctx context.Context, conv Conversation) {
 		env = "production"
 	}
 
-	jb, found := jobBoards[env]
-	if !found {
-		ReplyTo(conv).ErrorText("No job board is configured for the %s environment.", env).Send()
+	jb, ok := jobBoardFor(conv, env)
+	if !ok {
+		return
+	}
+
+	if requireApproval[env] {
+		msg := ReplyTo(conv).
+			AttachText("<@%s> wants to unregister an image in job-board-%s. Builds will no longer be able to use it.", conv.User(), env).
+			Field("Image", image).
+			ShortField("Environment", env).
+			ShortField("Infra", jb.Infra)
+
+		RequestApproval(conv, msg, roleReleaser, func(ctx context.Context, approver string) {
+			unregisterImage(ctx, conv, jb, env, image, approver)
+		})
 		return
 	}
 
-	if err := jb.DeleteImage(ctx, image); err != nil {
+	msg := ReplyTo(conv).
+		AttachText("<@%s>, are you sure you want to unregister this image? Builds will no longer be able to use it.", conv.User()).
+		Field("Image", image).
+		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+
+	Confirm(conv, msg, func(ctx context.Context) {
+		unregisterImage(ctx, conv, jb, env, image, "")
+	})
+}
+
+func unregisterImage(ctx context.Context, conv Conversation, jb *JobBoard, env string, image string, approver string) {
+	if err := unregisterTags(ctx, jb, env, image, conv.User(), approver); err != nil {
 		ReplyTo(conv).ErrorText("I couldn't unregister the image with job board.").Error(err).Send()
 		return
 	}
 
-	ReplyTo(conv).
+	msg := ReplyTo(conv).
 		AttachText("Successfully unregistered image for <@%s>", conv.User()).
 		Color("good").
 		Field("Image", image).
 		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+	addApprovalFields(msg, conv, approver)
+	msg.Send()
+}
+
+// SetImageTag sets one tag on an image in job board, leaving its other tags alone. An empty
+// value removes the tag.
+//
+// In environments that require approval, the tag is only set once someone else approves
+// the request.
+func SetImageTag(ctx context.Context, conv Conversation) {
+	image := conv.String("image")
+	env := conv.String("env")
+	if env == "" {
+		env = "production"
+	}
+
+	parts := strings.SplitN(conv.String("tag"), "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(conv.String("tag"), ",:") {
+		ReplyTo(conv).ErrorText("I don't understand the tag `%s`. Try something like `xcode=10.1`.", conv.String("tag")).Send()
+		return
+	}
+	key, value := parts[0], parts[1]
+
+	jb, ok := jobBoardFor(conv, env)
+	if !ok {
+		return
+	}
+
+	if !requireApproval[env] {
+		setImageTag(ctx, conv, jb, env, image, key, value, "")
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("<@%s> wants to change the tags of an image in job-board-%s.", conv.User(), env).
+		Field("Image", image).
+		ShortField("Tag", "%s", describeTagEdit(key, value)).
+		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+
+	RequestApproval(conv, msg, roleReleaser, func(ctx context.Context, approver string) {
+		setImageTag(ctx, conv, jb, env, image, key, value, approver)
+	})
+}
+
+func setImageTag(ctx context.Context, conv Conversation, jb *JobBoard, env string, image string, key string, value string, approver string) {
+	images, err := jb.ListImages(ctx)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't get the list of images from job board.").Error(err).Send()
+		return
+	}
+
+	var current *JobBoardImage
+	for i := range images {
+		if images[i].Name == image {
+			current = &images[i]
+		}
+	}
+	if current == nil {
+		ReplyTo(conv).ErrorText("There's no image named `%s` in job-board-%s on %s.", image, env, jb.Infra).Send()
+		return
+	}
+
+	tags := make(map[string]string)
+	for k, v := range current.Tags {
+		tags[k] = v
+	}
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+
+	if err := setTags(ctx, jb, env, images, image, tags, conv.User(), approver); err != nil {
+		ReplyTo(conv).ErrorText("I couldn't change the tags of the image in job board.").Error(err).Send()
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("Successfully changed the tags of an image for <@%s>", conv.User()).
+		Color("good").
+		Field("Image", image).
+		Field("Tags", "%s", describeTags(tags)).
+		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+	addApprovalFields(msg, conv, approver)
+	msg.Send()
+}
+
+// describeTagEdit says what setting a tag does, for messages.
+func describeTagEdit(key, value string) string {
+	if value == "" {
+		return fmt.Sprintf("remove `%s`", key)
+	}
+
+	return fmt.Sprintf("`%s:%s`", key, value)
+}
+
+// DiffImages shows the tags that are only registered in one of two job board environments,
+// or that point to different images in each.
+func DiffImages(ctx context.Context, conv Conversation) {
+	from, to := imageEnvs(conv)
+
+	fromTags, ok := loadImageTags(ctx, conv, from)
+	if !ok {
+		return
+	}
+	toTags, ok := loadImageTags(ctx, conv, to)
+	if !ok {
+		return
+	}
+
+	tags := make(map[string]bool)
+	for tag := range fromTags {
+		tags[tag] = true
+	}
+	for tag := range toTags {
+		tags[tag] = true
+	}
+
+	var diffs []string
+	for tag := range tags {
+		fromName, inFrom := fromTags[tag]
+		toName, inTo := toTags[tag]
+
+		switch {
+		case !inTo:
+			diffs = append(diffs, fmt.Sprintf("*%s*: only in %s (`%s`)", tag, from, fromName))
+		case !inFrom:
+			diffs = append(diffs, fmt.Sprintf("*%s*: only in %s (`%s`)", tag, to, toName))
+		case fromName != toName:
+			diffs = append(diffs, fmt.Sprintf("*%s*: `%s` in %s, `%s` in %s", tag, fromName, from, toName, to))
+		}
+	}
+
+	if len(diffs) == 0 {
+		ReplyTo(conv).Text("job-board-%s and job-board-%s have the same images.", from, to).Send()
+		return
+	}
+
+	sort.Strings(diffs)
+	ReplyTo(conv).
+		Text("Differences between job-board-%s and job-board-%s:\n\n%s", from, to, strings.Join(diffs, "\n")).
 		Send()
 }
+
+// PromoteImage registers the image a tag points to in one job board environment under the
+// same tag in another.
+//
+// In environments that require approval, the image is only registered once someone else
+// approves the request.
+func PromoteImage(ctx context.Context, conv Conversation) {
+	tag := conv.String("tag")
+	from, to := imageEnvs(conv)
+
+	jb, found := jobBoards[to]
+	if !found {
+		ReplyTo(conv).ErrorText("No job board is configured for the %s environment.", to).Send()
+		return
+	}
+
+	fromTags, ok := loadImageTags(ctx, conv, from)
+	if !ok {
+		return
+	}
+	image, found := fromTags[tag]
+	if !found {
+		ReplyTo(conv).ErrorText("There's no image tagged `%s` in job-board-%s.", tag, from).Send()
+		return
+	}
+
+	toTags, ok := loadImageTags(ctx, conv, to)
+	if !ok {
+		return
+	}
+	if toTags[tag] == image {
+		ReplyTo(conv).Text("`%s` already points to `%s` in job-board-%s.", tag, image, to).Send()
+		return
+	}
+
+	if !requireApproval[to] {
+		promoteImage(ctx, conv, jb, from, to, image, tag, "")
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("<@%s> wants to promote an image from job-board-%s to job-board-%s.", conv.User(), from, to).
+		Field("Image", image).
+		ShortField("Tag", tag).
+		ShortField("Environment", to)
+
+	RequestApproval(conv, msg, roleReleaser, func(ctx context.Context, approver string) {
+		promoteImage(ctx, conv, jb, from, to, image, tag, approver)
+	})
+}
+
+func promoteImage(ctx context.Context, conv Conversation, jb *JobBoard, from string, to string, image string, tag string, approver string) {
+	if err := registerTag(ctx, jb, to, image, tag, conv.User(), approver); err != nil {
+		ReplyTo(conv).ErrorText("I couldn't register the image with job board.").Error(err).Send()
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("Successfully promoted image from %s to %s for <@%s>", from, to, conv.User()).
+		Color("good").
+		Field("Image", image).
+		ShortField("Tag", tag).
+		ShortField("Environment", to)
+	addApprovalFields(msg, conv, approver)
+	msg.Send()
+}
+
+// imageEnvs returns the environments a command compares or promotes images between, which
+// are staging and production unless the user says otherwise.
+func imageEnvs(conv Conversation) (string, string) {
+	from := conv.String("from")
+	if from == "" {
+		from = "staging"
+	}
+	to := conv.String("to")
+	if to == "" {
+		to = "production"
+	}
+
+	return from, to
+}
+
+// loadImageTags gets the image each tag points to in a job board environment. If it can't,
+// it tells the user why and returns false.
+func loadImageTags(ctx context.Context, conv Conversation, env string) (map[string]string, bool) {
+	jb, found := jobBoards[env]
+	if !found {
+		ReplyTo(conv).ErrorText("No job board is configured for the %s environment.", env).Send()
+		return nil, false
+	}
+
+	images, err := jb.ListImages(ctx)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't get the list of images from job-board-%s.", env).Error(err).Send()
+		return nil, false
+	}
+
+	tags := make(map[string]string)
+	for _, i := range images {
+		if i.Tag != "" {
+			tags[i.Tag] = i.Name
+		}
+	}
+
+	return tags, true
+}
+
+// addApprovalFields records who asked for a change and who approved it, if it needed approval.
+func addApprovalFields(msg *MessageBuilder, conv Conversation, approver string) {
+	if approver == "" {
+		return
+	}
+
+	msg.ShortField("Requested by", "<@%s>", conv.User()).
+		ShortField("Approved by", "<@%s>", approver)
+}
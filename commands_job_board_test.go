@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// baseImagesBackend is a debug backend with the given base VMs in every pod.
+type baseImagesBackend struct {
+	*DebugBackend
+	names []string
+}
+
+func (b baseImagesBackend) BaseImages(ctx context.Context, pod string) ([]Image, error) {
+	var images []Image
+	for _, name := range b.names {
+		images = append(images, DebugImage(name))
+	}
+
+	return images, nil
+}
+
+// setupBaseImages resets the backend so that the base VMs in every pod have the given names.
+func setupBaseImages(names ...string) {
+	resetBackend()
+	backend = baseImagesBackend{backend.(*DebugBackend), names}
+}
+
+// setupImageJobBoards points the staging and production job boards at test servers that list
+// the given tags and images, and record the images registered in them.
+func setupImageJobBoards(images map[string]map[string]string) (map[string][]string, func()) {
+	registered := make(map[string][]string)
+	jobBoards = make(map[string]*JobBoard)
+
+	var servers []*httptest.Server
+	for env, tags := range images {
+		env, tags := env, tags
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				registered[env] = append(registered[env], r.FormValue("name")+" "+r.FormValue("tags"))
+				return
+			}
+
+			var list imageListPayload
+			for tag, name := range tags {
+				list.Data = append(list.Data, imagePayload{Name: name, Tags: map[string]string{"osx_image": tag}})
+			}
+			json.NewEncoder(w).Encode(list)
+		}))
+		servers = append(servers, srv)
+		jobBoards[env] = NewJobBoard(srv.URL, "secret")
+	}
+
+	requireApproval = map[string]bool{}
+	approvals = NewApprovals(time.Hour)
+
+	return registered, func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+		jobBoards = nil
+		requireApproval = nil
+	}
+}
+
+var testImages = map[string]map[string]string{
+	"staging": {
+		"xcode9":  "xcode9-1000",
+		"xcode10": "xcode10-2000",
+		"xcode11": "xcode11-3000",
+	},
+	"production": {
+		"xcode8":  "xcode8-500",
+		"xcode9":  "xcode9-1000",
+		"xcode10": "xcode10-1500",
+	},
+}
+
+func TestDiffImages(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+
+	conv := newTestConversation("diff images")
+	DiffImages(context.TODO(), conv)
+
+	require.Equal(t, "<@user>: Differences between job-board-staging and job-board-production:\n\n"+
+		"*xcode10*: `xcode10-2000` in staging, `xcode10-1500` in production\n"+
+		"*xcode11*: only in staging (`xcode11-3000`)\n"+
+		"*xcode8*: only in production (`xcode8-500`)", conv.replies[0].text)
+}
+
+func TestDiffImagesSame(t *testing.T) {
+	_, done := setupImageJobBoards(map[string]map[string]string{
+		"staging":    testImages["staging"],
+		"production": testImages["staging"],
+	})
+	defer done()
+
+	conv := newTestConversation("diff images")
+	DiffImages(context.TODO(), conv)
+
+	require.Equal(t, "<@user>: job-board-staging and job-board-production have the same images.", conv.replies[0].text)
+}
+
+func promoteImageForTest(tag string) *testConversation {
+	conv := newTestConversation("promote image " + tag + " from staging to production")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"tag":  tag,
+		"from": "staging",
+		"to":   "production",
+	}))
+	PromoteImage(context.TODO(), conv)
+	return conv
+}
+
+func TestPromoteImage(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+
+	conv := promoteImageForTest("xcode10")
+
+	require.Equal(t, []string{"xcode10-2000 os:osx,osx_image:xcode10"}, registered["production"])
+	require.Equal(t, "Successfully promoted image from staging to production for <@user>", conv.replies[0].text)
+}
+
+func TestPromoteImageNeedsApproval(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+	requireApproval["production"] = true
+
+	conv := promoteImageForTest("xcode11")
+	require.Empty(t, registered["production"])
+	require.Contains(t, conv.replies[0].text, "<@user> wants to promote an image from job-board-staging to job-board-production.")
+
+	require.NoError(t, approvals.Approve(context.TODO(), approvalID(conv), "approver"))
+	require.Equal(t, []string{"xcode11-3000 os:osx,osx_image:xcode11"}, registered["production"])
+}
+
+func TestPromoteImageErrors(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+
+	conv := promoteImageForTest("xcode8")
+	require.Equal(t, "Sorry, <@user>! There's no image tagged `xcode8` in job-board-staging.", conv.replies[0].text)
+
+	conv = promoteImageForTest("xcode9")
+	require.Equal(t, "<@user>: `xcode9` already points to `xcode9-1000` in job-board-production.", conv.replies[0].text)
+
+	require.Empty(t, registered)
+}
+
+func registerImageInStagingForTest(image string, tag string) *testConversation {
+	conv := newTestConversation("register image " + image + " as " + tag + " in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": image,
+		"tag":   tag,
+		"env":   "staging",
+	}))
+	RegisterImage(context.TODO(), conv)
+	return conv
+}
+
+func TestRegisterImageChecksBaseImages(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages("xcode12-1000", "xcode12-2000", "xcode11-3000", "sierra-1000")
+
+	conv := registerImageInStagingForTest("xcode12-100", "xcode12")
+	require.Equal(t, "Sorry, <@user>! There's no base VM named `xcode12-100` in pod-1, so I didn't register it. Did you mean `xcode12-1000` or `xcode12-2000`? Use `force register image` if you're sure.", conv.replies[0].text)
+
+	conv = registerImageInStagingForTest("catalina", "xcode12")
+	require.Equal(t, "Sorry, <@user>! There's no base VM named `catalina` in pod-1, so I didn't register it. Use `force register image` if you're sure.", conv.replies[0].text)
+	require.Empty(t, registered)
+
+	conv = newTestConversation("force register image catalina as xcode12 in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "catalina",
+		"tag":   "xcode12",
+		"env":   "staging",
+	}))
+	ForceRegisterImage(context.TODO(), conv)
+	require.Equal(t, "Successfully registered image for <@user>", conv.replies[0].text)
+
+	conv = registerImageInStagingForTest("xcode12-1000", "xcode12")
+	require.Equal(t, "Successfully registered image for <@user>", conv.replies[0].text)
+	require.Equal(t, []string{"catalina os:osx,osx_image:xcode12", "xcode12-1000 os:osx,osx_image:xcode12"}, registered["staging"])
+}
+
+func TestRegisterImageUsesJobBoardPod(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages()
+	jobBoardPods = map[string]string{"staging": "pod-2"}
+	defer func() { jobBoardPods = nil }()
+
+	conv := registerImageInStagingForTest("xcode12-1000", "xcode12")
+	require.Contains(t, conv.replies[0].text, "There's no base VM named `xcode12-1000` in pod-2")
+}
+
+func TestRegisterImageWarnsAboutReplacedImage(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+	setupBaseImages("xcode10-3000")
+	confirmations = NewConfirmations(time.Hour)
+
+	conv := registerImageInStagingForTest("xcode10-3000", "xcode10")
+	require.Contains(t, conv.replies[0].text, "<@user>, `xcode10` already points to `xcode10-2000` in job-board-staging. Are you sure you want to replace it?")
+	require.Empty(t, registered)
+
+	clickButton(conv, "user", "confirm")
+	require.Equal(t, []string{"xcode10-3000 os:osx,osx_image:xcode10"}, registered["staging"])
+	require.Equal(t, "Successfully registered image for <@user>", conv.replies[len(conv.replies)-1].text)
+
+	requireApproval["staging"] = true
+	conv = registerImageInStagingForTest("xcode10-3000", "xcode10")
+	require.Contains(t, conv.replies[0].text, "<@user> wants to register an image in job-board-staging.")
+	require.Contains(t, conv.replies[0].fields, messageField{title: "Replaces", value: "`xcode10-2000`"})
+}
+
+func TestRegisterImageNeedsImageList(t *testing.T) {
+	jb, _, done := testJobBoard(testResponse{401, ""})
+	defer done()
+	jobBoards = map[string]*JobBoard{"staging": jb}
+	defer func() { jobBoards = nil }()
+	setupBaseImages("xcode10-3000")
+
+	conv := registerImageInStagingForTest("xcode10-3000", "xcode10")
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "Sorry, <@user>! I couldn't get the list of images on jupiterbrain from job-board-staging, so I can't tell what `xcode10` points to now. I didn't register it.", conv.replies[0].text)
+}
+
+func TestCloseMatches(t *testing.T) {
+	require.Equal(t, 0, editDistance("xcode10", "xcode10"))
+	require.Equal(t, 1, editDistance("xcode10", "xcode1"))
+	require.Equal(t, 3, editDistance("kitten", "sitting"))
+
+	candidates := []string{"xcode10-2000", "xcode10-1000", "xcode9-1000", "high-sierra"}
+	require.Equal(t, []string{"xcode10-1000", "xcode10-2000"}, closeMatches("xcode10-100", candidates))
+	require.Equal(t, []string{"xcode9-1000"}, closeMatches("xcode9-100", candidates))
+	require.Empty(t, closeMatches("catalina", candidates))
+}
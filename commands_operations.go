@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"strconv"
+	"strings"
+)
+
+// RunningOperations lists the long-running commands that haven't finished yet.
+func RunningOperations(ctx context.Context, conv Conversation) {
+	ops := operations.Running()
+	if len(ops) == 0 {
+		ReplyTo(conv).Text("Nothing is running right now.").Send()
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Running operations:\n")
+	for _, op := range ops {
+		fmt.Fprintf(&b, "\n• `%d` %s for <@%s> in <#%s>, started %s", op.ID, op.Description, op.User, op.Channel, humanize.Time(op.StartedAt))
+	}
+	b.WriteString("\n\nSay `cancel <id>` to stop one.")
+
+	ReplyTo(conv).Text(b.String()).Send()
+}
+
+// CancelOperation stops a running operation by its ID.
+func CancelOperation(ctx context.Context, conv Conversation) {
+	s := conv.String("operation")
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		ReplyTo(conv).ErrorText("`%s` isn't an operation ID. Try `running operations` to find the one you want.", s).Send()
+		return
+	}
+
+	op, err := operations.Cancel(ctx, id, conv.User())
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't cancel that operation: %s.", err).Send()
+		return
+	}
+
+	ReplyTo(conv).Text("Cancelling `%s` for <@%s>.", op.Description, op.User).Send()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/travis-ci/imaged/rpc/images"
+	"strconv"
+)
+
+// releaseEnvs are the job board environments an image is registered in when it's released,
+// in order.
+var releaseEnvs = []string{"staging", "production"}
+
+// ReleaseImage builds an image, registers the base VM it makes in staging, and then promotes
+// it to production once the user confirms, all reported in a single message.
+//
+// If staging requires approval, someone else has to approve registering the image there. If
+// production does, someone else has to approve the promotion instead of the user confirming.
+func ReleaseImage(ctx context.Context, conv Conversation) {
+	image := conv.String("image")
+	tag := conv.String("tag")
+	branch := conv.String("branch")
+	if branch == "" {
+		branch = "master"
+	}
+
+	for _, env := range releaseEnvs {
+		if _, found := jobBoards[env]; !found {
+			ReplyTo(conv).ErrorText("No job board is configured for the %s environment, so I can't release images.", env).Send()
+			return
+		}
+	}
+
+	resp, err := imagesClient.StartBuild(ctx, &images.StartBuildRequest{
+		Name:     image,
+		Revision: branch,
+	})
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't start the build.").Error(err).Send()
+		return
+	}
+
+	r := &release{
+		conv:  conv,
+		image: resp.Build.Name,
+		tag:   tag,
+		pod:   podName(conv),
+	}
+	r.msg = ReplyTo(conv).
+		AttachText("Releasing %s image as `%s` for <@%s>…", r.image, tag, conv.User()).
+		ShortField("Build", "%s", releaseBuildStatus(resp.Build)).
+		ShortField("Base VM", "Waiting for the build").
+		ShortField("Staging", "Waiting").
+		ShortField("Production", "Waiting").
+		InThread().
+		Send()
+
+	if !r.stage(ctx, resp.Build.Id) {
+		return
+	}
+	r.promote()
+}
+
+// release is an image making its way from a build to production.
+type release struct {
+	conv  Conversation
+	msg   *MessageBuilder
+	image string
+	tag   string
+	pod   string
+	vm    string
+}
+
+// stage waits for the image to build and registers it in staging. It returns false if the
+// release can't go any further yet, either because something failed or because registering
+// it in staging is waiting for approval.
+func (r *release) stage(ctx context.Context, buildID int64) bool {
+	ctx, op, done := operations.Start(ctx, r.conv, fmt.Sprintf("release image %s as %s", r.image, r.tag))
+	defer done()
+
+	r.msg.Footer(fmt.Sprintf("Operation %d", op.ID), op.StartedAt).Send()
+
+	build, err := pollBuild(ctx, buildID, func(b *images.Build) {
+		r.msg.ReplaceField("Build", "%s", releaseBuildStatus(b)).Send()
+	})
+	if err != nil {
+		if !op.reportCancelled(r.msg) {
+			r.fail("Build", fmt.Sprintf("I stopped waiting for the %s image to build.", r.image), err)
+		}
+		return false
+	}
+	if build.Status != images.Build_SUCCEEDED {
+		r.fail("Build", fmt.Sprintf("The %s image failed to build, so I didn't release it.", r.image), nil)
+		return false
+	}
+
+	vms, err := backend.BaseImages(ctx, r.pod)
+	if err != nil {
+		r.fail("Base VM", "I couldn't get the list of base images.", err)
+		return false
+	}
+	vm, found := builtImage(vms, build)
+	if !found {
+		r.fail("Base VM", fmt.Sprintf("I couldn't find the base VM the %s image build made in %s.", r.image, r.pod), nil)
+		return false
+	}
+	r.vm = vm
+	r.msg.ReplaceField("Base VM", "`%s`", vm).Send()
+
+	if requireApproval["staging"] {
+		r.msg.AttachText("<@%s> wants to register the %s image in staging as `%s`.", r.conv.User(), r.image, r.tag).
+			ReplaceField("Staging", "Needs approval")
+		RequestApproval(r.conv, r.msg, roleReleaser, func(ctx context.Context, approver string) {
+			if r.registerStaging(ctx, approver) {
+				r.promote()
+			}
+		})
+		return false
+	}
+
+	return r.registerStaging(ctx, "")
+}
+
+// registerStaging registers the built image in staging. It returns false if that failed.
+func (r *release) registerStaging(ctx context.Context, approver string) bool {
+	if err := registerTag(ctx, jobBoards["staging"], "staging", r.vm, r.tag, r.conv.User(), approver); err != nil {
+		r.fail("Staging", "I couldn't register the image with job board.", err)
+		return false
+	}
+
+	if approver != "" {
+		r.msg.ReplaceField("Staging", ":white_check_mark: Registered, approved by <@%s>", approver).Send()
+	} else {
+		r.msg.ReplaceField("Staging", ":white_check_mark: Registered").Send()
+	}
+	return true
+}
+
+// promote asks the user to confirm, or someone else to approve, registering the image in
+// production.
+func (r *release) promote() {
+	if requireApproval["production"] {
+		r.msg.AttachText("<@%s> wants to promote the %s image to production as `%s`.", r.conv.User(), r.image, r.tag).
+			ReplaceField("Production", "Needs approval")
+		RequestApproval(r.conv, r.msg, roleReleaser, r.finish)
+		return
+	}
+
+	r.msg.AttachText("<@%s>, the %s image is registered in staging as `%s`. Are you sure you want to promote it to production?", r.conv.User(), r.image, r.tag).
+		ReplaceField("Production", "Needs confirmation")
+	Confirm(r.conv, r.msg, func(ctx context.Context) {
+		r.finish(ctx, "")
+	})
+}
+
+// finish registers the image in production and lets the user know it has been released.
+func (r *release) finish(ctx context.Context, approver string) {
+	if err := registerTag(ctx, jobBoards["production"], "production", r.vm, r.tag, r.conv.User(), approver); err != nil {
+		r.fail("Production", "I couldn't register the image with job board.", err)
+		return
+	}
+	r.msg.Color("good").
+		ReplaceField("Production", ":white_check_mark: Registered").
+		Send()
+
+	msg := ReplyTo(r.conv).
+		AttachText("Successfully released %s image for <@%s>", r.image, r.conv.User()).
+		Color("good").
+		Field("Image", r.vm).
+		ShortField("Tag", r.tag).
+		Broadcast()
+	addApprovalFields(msg, r.conv, approver)
+	msg.Send()
+}
+
+// fail marks a stage of the release as failed, and tells the user why in a new message.
+func (r *release) fail(stage string, text string, err error) {
+	r.msg.Color("danger").
+		ReplaceField(stage, ":x: Failed").
+		Send()
+
+	ReplyTo(r.conv).ErrorText("%s", text).Error(err).Broadcast().Send()
+}
+
+func releaseBuildStatus(b *images.Build) string {
+	return fmt.Sprintf("`%d` %s", b.Id, buildStatus(b))
+}
+
+// builtImage finds the base VM that a build made. Base VMs are named after the template they
+// were built from and the time they were made, so this is the newest VM of the build's
+// template made while the build was running.
+func builtImage(vms []Image, b *images.Build) (string, bool) {
+	started := b.StartedAt
+	if started == 0 {
+		started = b.CreatedAt
+	}
+
+	var name string
+	newest := int64(-1)
+	for _, vm := range vms {
+		// Other templates may have been building at the same time
+		if newBaseImage(vm).Template != b.Name {
+			continue
+		}
+
+		ts, err := strconv.ParseInt(extractTimestamp(vm), 10, 64)
+		if err != nil || ts < started || (b.FinishedAt != 0 && ts > b.FinishedAt) {
+			continue
+		}
+		if ts > newest {
+			name = vm.Name()
+			newest = ts
+		}
+	}
+
+	return name, newest >= 0
+}
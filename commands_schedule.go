@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// ScheduleCommand returns a handler that schedules a command to run over and over, either
+// in the channel the user named or the one they're in.
+//
+// The command has to be one the router knows, so that mistakes are caught right away
+// instead of every time it runs.
+func ScheduleCommand(router *Router) HandlerFunc {
+	return func(ctx context.Context, conv Conversation) {
+		command := strings.Trim(conv.String("command"), "\"“” ")
+		// Patterns match anywhere in the text, so the matched pattern doesn't say whether the
+		// command itself is a schedule
+		if strings.HasPrefix(strings.ToLower(command), "schedule") {
+			ReplyTo(conv).ErrorText("I can't schedule scheduling a command.").Send()
+			return
+		}
+		if _, ok := router.Match(command); !ok {
+			ReplyTo(conv).ErrorText("I don't know how to `%s`, so I can't schedule it.", command).Send()
+			return
+		}
+
+		s := conv.String("spec")
+		spec, err := ParseScheduleSpec(s)
+		if err != nil {
+			ReplyTo(conv).ErrorText("I can't schedule that: %s.", err).Send()
+			return
+		}
+
+		channel := conv.Channel()
+		if c := conv.String("channel"); c != "" {
+			channel = slackChannelID(c)
+			if channel == "" {
+				ReplyTo(conv).ErrorText("I don't know which channel `%s` is. Mention it like #channel.", c).Send()
+				return
+			}
+		}
+
+		now := time.Now()
+		sch := Schedule{
+			ID:        randomID(),
+			User:      conv.User(),
+			Channel:   channel,
+			Command:   command,
+			Spec:      s,
+			CreatedAt: now,
+			NextRun:   spec.Next(now),
+		}
+		if err := schedules.Put(sch); err != nil {
+			ReplyTo(conv).ErrorText("I couldn't save that schedule.").Error(err).Send()
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"schedule": sch.ID,
+			"user":     sch.User,
+			"command":  sch.Command,
+			"spec":     sch.Spec,
+		}).Info("scheduled command")
+		ReplyTo(conv).
+			Text("Scheduled %s. It runs next %s. Say `unschedule %s` to stop it.", describeSchedule(sch), humanize.Time(sch.NextRun), sch.ID).
+			Send()
+	}
+}
+
+// ListSchedules lists every scheduled command.
+func ListSchedules(ctx context.Context, conv Conversation) {
+	all := schedules.All()
+	if len(all) == 0 {
+		ReplyTo(conv).Text("Nothing is scheduled right now.").Send()
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Scheduled commands:\n")
+	for _, sch := range all {
+		fmt.Fprintf(&b, "\n• `%s` %s for <@%s>, next %s", sch.ID, describeSchedule(sch), sch.User, humanize.Time(sch.NextRun))
+	}
+
+	ReplyTo(conv).Text(b.String()).Send()
+}
+
+// UnscheduleCommand returns a handler that stops a scheduled command from running again.
+// Users can always unschedule their own commands, but need the operator role to
+// unschedule anyone else's.
+func UnscheduleCommand(roles *Roles) HandlerFunc {
+	return func(ctx context.Context, conv Conversation) {
+		id := conv.String("schedule")
+		sch, found := schedules.Get(id)
+		if !found {
+			ReplyTo(conv).ErrorText("There is no scheduled command with ID `%s`. Try `list schedules` to find the one you want.", id).Send()
+			return
+		}
+
+		if sch.User != conv.User() && roles != nil {
+			ok, err := roles.HasRole(ctx, conv.User(), roleOperator)
+			if err != nil || !ok {
+				ReplyTo(conv).ErrorText("Only <@%s> or someone with the %s role can unschedule that.", sch.User, roleOperator).Send()
+				return
+			}
+		}
+
+		if err := schedules.Delete(id); err != nil {
+			ReplyTo(conv).ErrorText("I couldn't unschedule that.").Error(err).Send()
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"schedule": id,
+			"user":     conv.User(),
+		}).Info("unscheduled command")
+		ReplyTo(conv).Text("Unscheduled %s.", describeSchedule(sch)).Send()
+	}
+}
+
+// slackChannelID extracts a channel ID from a Slack channel link like <#C012AB3CD> or
+// <#C012AB3CD|general>. Command text is lowercased, so the ID is put back in upper case.
+// Anything else returns an empty string.
+func slackChannelID(s string) string {
+	if !strings.HasPrefix(s, "<#") || !strings.HasSuffix(s, ">") {
+		return ""
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(s, "<#"), ">")
+	if i := strings.Index(id, "|"); i >= 0 {
+		id = id[:i]
+	}
+	return strings.ToUpper(id)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"strings"
+)
+
+// maxTagChanges is the most tag changes shown in one reply.
+const maxTagChanges = 20
+
+// ShowTagHistory lists the changes the bot has made to which image a tag points to in a job
+// board environment, newest first.
+func ShowTagHistory(ctx context.Context, conv Conversation) {
+	tag := conv.String("tag")
+	env := conv.String("env")
+	if env == "" {
+		env = "production"
+	}
+
+	// The history is kept by the bot, so it can be shown even if the job board is gone
+	infra := conv.String("infra")
+	if infra == "" {
+		infra = defaultJobBoardInfra
+		if jb, found := jobBoards[env]; found {
+			infra = jb.Infra
+		}
+	}
+
+	changes, err := tagHistory.Changes(env, infra, tag)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't read the tag history.").Error(err).Send()
+		return
+	}
+
+	if len(changes) == 0 {
+		ReplyTo(conv).Text("I haven't changed `%s` in job-board-%s on %s.", tag, env, infra).Send()
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Changes to `%s` in job-board-%s on %s:\n", tag, env, infra)
+	for i, c := range changes {
+		if i == maxTagChanges {
+			fmt.Fprintf(&b, "\n…and %d more.", len(changes)-maxTagChanges)
+			break
+		}
+
+		fmt.Fprintf(&b, "\n• %s %s", describeTagChange(c), humanize.Time(c.ChangedAt))
+	}
+
+	ReplyTo(conv).Text(b.String()).Send()
+}
+
+func describeTagChange(c TagChange) string {
+	var s string
+	switch {
+	case c.OldImage == "":
+		s = fmt.Sprintf("<@%s> registered `%s`", c.User, c.NewImage)
+	case c.NewImage == "":
+		s = fmt.Sprintf("<@%s> unregistered `%s`", c.User, c.OldImage)
+	default:
+		s = fmt.Sprintf("<@%s> changed it from `%s` to `%s`", c.User, c.OldImage, c.NewImage)
+	}
+
+	if c.ApprovedBy != "" {
+		s += fmt.Sprintf(", approved by <@%s>,", c.ApprovedBy)
+	}
+	return s
+}
+
+// RollbackTag undoes the last change the bot made to a tag in a job board environment, by
+// registering the image it pointed to before.
+//
+// In environments that require approval, the image is only registered once someone else
+// approves the request.
+func RollbackTag(ctx context.Context, conv Conversation) {
+	tag := conv.String("tag")
+	env := conv.String("env")
+	if env == "" {
+		env = "production"
+	}
+
+	jb, ok := jobBoardFor(conv, env)
+	if !ok {
+		return
+	}
+
+	changes, err := tagHistory.Changes(env, jb.Infra, tag)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't read the tag history.").Error(err).Send()
+		return
+	}
+	if len(changes) == 0 {
+		ReplyTo(conv).ErrorText("I haven't changed `%s` in job-board-%s, so I don't know what to roll it back to.", tag, env).Send()
+		return
+	}
+
+	last := changes[0]
+	if last.OldImage == "" {
+		ReplyTo(conv).ErrorText("`%s` didn't point to an image in job-board-%s before <@%s> registered `%s`, so there's nothing to roll it back to.", tag, env, last.User, last.NewImage).Send()
+		return
+	}
+
+	if !requireApproval[env] {
+		rollbackTag(ctx, conv, jb, env, tag, last, "")
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("<@%s> wants to roll back a tag in job-board-%s.", conv.User(), env).
+		Field("Image", last.OldImage).
+		ShortField("Tag", tag).
+		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+
+	RequestApproval(conv, msg, roleReleaser, func(ctx context.Context, approver string) {
+		rollbackTag(ctx, conv, jb, env, tag, last, approver)
+	})
+}
+
+func rollbackTag(ctx context.Context, conv Conversation, jb *JobBoard, env string, tag string, last TagChange, approver string) {
+	if err := registerTag(ctx, jb, env, last.OldImage, tag, conv.User(), approver); err != nil {
+		ReplyTo(conv).ErrorText("I couldn't register the image with job board.").Error(err).Send()
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("Successfully rolled back tag for <@%s>", conv.User()).
+		Color("good").
+		Field("Image", last.OldImage).
+		ShortField("Tag", tag).
+		ShortField("Environment", env).
+		ShortField("Infra", jb.Infra)
+	addApprovalFields(msg, conv, approver)
+	msg.Send()
+}
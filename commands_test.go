@@ -5,32 +5,50 @@ import (
 	"github.com/shomali11/proper"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func resetBackend() {
-	backend = &DebugBackend{
-		Host:         DebugHost("1.2.3.4"),
-		disableSleep: true,
+	defaultPod = "pod-1"
+	defaultBackupPod = "pod-2"
+	backupPods = map[string]bool{"pod-2": true}
+	b := NewDebugBackend("1.2.3.4", "1.2.3.5", "1.2.3.6")
+	b.disableSleep = true
+	backend = b
+	maxCheckedOutHosts = map[string]int{"pod-1": 2}
+	leases, _ = NewLeaseStore("")
+	leaseConfig = LeaseConfig{
+		Default: 8 * time.Hour,
+		Max:     72 * time.Hour,
+		Warning: 30 * time.Minute,
 	}
 }
 
+func isDebugHostCheckedOut(name string) bool {
+	b := backend.(*DebugBackend)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.checkedOut[DebugHost(name)]
+}
+
 func TestIsHostCheckedOut(t *testing.T) {
 	resetBackend()
 	conv := newTestConversation("is checked out")
 	IsHostCheckedOut(context.TODO(), conv)
 
 	reply := conv.replies[0]
-	require.Contains(t, reply.text, "There is no host checked out for building images.")
+	require.Contains(t, reply.text, "There is no host checked out for building images in pod-1.")
 
 	// now check out a host and try again
-	host, _ := backend.SelectHost(context.TODO())
-	backend.CheckOutHost(context.TODO(), host)
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
 
 	conv = newTestConversation("is checked out")
 	IsHostCheckedOut(context.TODO(), conv)
 
 	reply = conv.replies[0]
-	require.Contains(t, reply.text, "There is a host currently checked out for building images.")
+	require.Contains(t, reply.text, "There is a host currently checked out for building images in pod-1.")
 }
 
 func TestCheckOutHost(t *testing.T) {
@@ -42,6 +60,8 @@ func TestCheckOutHost(t *testing.T) {
 	reply := conv.replies[0]
 	require.Equal(t, "Choosing a host to check out for <@user>…", reply.text)
 	require.True(t, reply.isAttachment)
+	require.True(t, reply.inThread, "expected progress to be in a thread")
+	require.False(t, reply.broadcast)
 
 	reply = conv.replies[1]
 	require.Equal(t, "Checking out host for <@user>…", reply.text)
@@ -54,43 +74,240 @@ func TestCheckOutHost(t *testing.T) {
 	require.Equal(t, f, reply.fields[0])
 	require.Equal(t, "good", reply.color)
 	require.Empty(t, reply.timestamp, "expected reply 2 to be its own message")
+	require.True(t, reply.broadcast, "expected the result to be broadcast to the channel")
+
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+
+	lease, found := leases.Get("pod-1", "1.2.3.4")
+	require.True(t, found)
+	require.Equal(t, "user", lease.Owner)
+	require.Equal(t, 8*time.Hour, lease.ExpiresAt.Sub(lease.CheckedOutAt))
+}
+
+func TestCheckOutHostWithDuration(t *testing.T) {
+	resetBackend()
+	conv := newTestConversation("check out host for 4h")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"duration": "4h",
+	}))
+	CheckOutHost(context.TODO(), conv)
+
+	reply := conv.replies[2]
+	require.Equal(t, "Successfully checked out host for <@user>!", reply.text)
+	require.Contains(t, reply.fields, messageField{title: "Lease", value: "4h0m0s", short: true})
+
+	lease, found := leases.Get("pod-1", "1.2.3.4")
+	require.True(t, found)
+	require.Equal(t, 4*time.Hour, lease.ExpiresAt.Sub(lease.CheckedOutAt))
+}
+
+func TestCheckOutHostTooLong(t *testing.T) {
+	resetBackend()
+	conv := newTestConversation("check out host for 100h")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"duration": "100h",
+	}))
+	CheckOutHost(context.TODO(), conv)
 
-	require.True(t, backend.(*DebugBackend).isCheckedOut)
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "Sorry, <@user>! You can only check out a host for up to 72h0m0s at a time.", conv.replies[0].text)
+	require.False(t, isDebugHostCheckedOut("1.2.3.4"))
+}
+
+func TestIsHostCheckedOutShowsLease(t *testing.T) {
+	resetBackend()
+	CheckOutHost(context.TODO(), newTestConversation("check out host"))
+
+	conv := newTestConversation("is checked out")
+	IsHostCheckedOut(context.TODO(), conv)
+
+	reply := conv.replies[0]
+	require.Contains(t, reply.fields, messageField{title: "Owner", value: "<@user>", short: true})
+	require.Contains(t, reply.fields, messageField{title: "Lease", value: "Expires 7 hours from now", short: true})
+}
+
+func TestExtendLease(t *testing.T) {
+	resetBackend()
+	CheckOutHost(context.TODO(), newTestConversation("check out host"))
+	before, _ := leases.Get("pod-1", "1.2.3.4")
+
+	conv := newTestConversation("extend lease by 2h")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"duration": "2h",
+	}))
+	ExtendLease(context.TODO(), conv)
+
+	require.Equal(t, "Extended lease for <@user>.", conv.replies[0].text)
+	after, _ := leases.Get("pod-1", "1.2.3.4")
+	require.Equal(t, 2*time.Hour, after.ExpiresAt.Sub(before.ExpiresAt))
+}
+
+func TestExtendLeaseNothingCheckedOut(t *testing.T) {
+	resetBackend()
+
+	conv := newTestConversation("extend lease")
+	ExtendLease(context.TODO(), conv)
+
+	require.Equal(t, "Sorry, <@user>! You don't have any hosts checked out right now!", conv.replies[0].text)
 }
 
 func TestCheckOutHostAlreadyOut(t *testing.T) {
 	resetBackend()
-	host, _ := backend.SelectHost(context.TODO())
-	backend.CheckOutHost(context.TODO(), host)
+	maxCheckedOutHosts["pod-1"] = 1
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
 
 	conv := newTestConversation("check out host")
 	CheckOutHost(context.TODO(), conv)
 
 	reply := conv.replies[0]
-	require.Equal(t, "Sorry, <@user>! Looks like there's already a host checked out for building images!", reply.text)
+	require.Equal(t, "Sorry, <@user>! Looks like there's already a host checked out for building images in pod-1, and only 1 can be checked out at once!", reply.text)
+}
+
+func TestCheckOutMultipleHosts(t *testing.T) {
+	resetBackend()
+	conv := newTestConversation("check out 2 hosts")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"count": "2",
+	}))
+	CheckOutHost(context.TODO(), conv)
+
+	require.Len(t, conv.replies, 4)
+	require.Equal(t, "Checking out host 1 of 2 for <@user>…", conv.replies[1].text)
+	require.Equal(t, "Checking out host 2 of 2 for <@user>…", conv.replies[2].text)
+
+	reply := conv.replies[3]
+	require.Equal(t, "Successfully checked out 2 hosts for <@user>!", reply.text)
+	require.Equal(t, messageField{title: "Host", value: ":desktop_computer: 1.2.3.4"}, reply.fields[0])
+	require.Equal(t, messageField{title: "Host", value: ":desktop_computer: 1.2.3.5"}, reply.fields[1])
+
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+	require.True(t, isDebugHostCheckedOut("1.2.3.5"))
+	require.Len(t, leases.ForOwner("user"), 2)
+
+	conv = newTestConversation("is checked out")
+	IsHostCheckedOut(context.TODO(), conv)
+	require.Contains(t, conv.replies[0].text, "There are 2 hosts currently checked out for building images in pod-1.")
+}
+
+func TestCheckOutTooManyHosts(t *testing.T) {
+	resetBackend()
+	conv := newTestConversation("check out 3 hosts")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"count": "3",
+	}))
+	CheckOutHost(context.TODO(), conv)
+
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "Sorry, <@user>! Only 2 can be checked out in pod-1 at once!", conv.replies[0].text)
+	require.False(t, isDebugHostCheckedOut("1.2.3.4"))
 }
 
 func TestCheckInHost(t *testing.T) {
 	resetBackend()
-	host, _ := backend.SelectHost(context.TODO())
-	backend.CheckOutHost(context.TODO(), host)
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
 
 	conv := newTestConversation("check in host")
 	CheckInHost(context.TODO(), conv)
 
-	require.Len(t, conv.replies, 2)
+	require.Len(t, conv.replies, 1)
 	reply := conv.replies[0]
+	require.Equal(t, "<@user>, are you sure you want to check in this host? Any image builds running on it will be interrupted.", reply.text)
+	f := messageField{title: "Host", value: ":desktop_computer: 1.2.3.4"}
+	require.Equal(t, f, reply.fields[0])
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+
+	clickButton(conv, "user", "confirm")
+
+	require.Len(t, conv.replies, 4)
+	reply = conv.replies[2]
 	require.Equal(t, "Checking the host in for <@user>…", reply.text)
 	require.True(t, reply.isAttachment)
 
-	reply = conv.replies[1]
+	reply = conv.replies[3]
 	require.Equal(t, "Successfully checked in host for <@user>!", reply.text)
-	f := messageField{title: "Host", value: ":desktop_computer: 1.2.3.4"}
 	require.Equal(t, f, reply.fields[0])
 	require.Equal(t, "good", reply.color)
-	require.Empty(t, reply.timestamp, "expected reply 1 to be its own message")
+	require.Empty(t, reply.timestamp, "expected reply 3 to be its own message")
+
+	require.False(t, isDebugHostCheckedOut("1.2.3.4"))
 
-	require.False(t, backend.(*DebugBackend).isCheckedOut)
+	_, found := leases.Get("pod-1", "1.2.3.4")
+	require.False(t, found)
+}
+
+func TestCheckInNamedHost(t *testing.T) {
+	resetBackend()
+	for i := 0; i < 2; i++ {
+		host, _ := backend.SelectHost(context.TODO(), "pod-1")
+		backend.CheckOutHost(context.TODO(), "pod-1", host)
+	}
+
+	conv := newTestConversation("check in host 1.2.3.5")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"host": "1.2.3.5",
+	}))
+	CheckInHost(context.TODO(), conv)
+	clickButton(conv, "user", "confirm")
+
+	require.Equal(t, "Successfully checked in host for <@user>!", conv.replies[3].text)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+	require.False(t, isDebugHostCheckedOut("1.2.3.5"))
+}
+
+func TestCheckInHostCommands(t *testing.T) {
+	resetBackend()
+	host, _ := backend.SelectHost(context.TODO(), "pod-2")
+	backend.CheckOutHost(context.TODO(), "pod-2", host)
+
+	router := NewRouter()
+	addCommands(router)
+
+	for _, command := range []string{
+		"check in host in pod-2",
+		"checkin host in pod-2",
+		"check in host 1.2.3.4 in pod-2",
+		"checkin host 1.2.3.4 in pod-2",
+	} {
+		conv := newTestConversation(command)
+		router.Reply(context.TODO(), conv)
+
+		require.Len(t, conv.replies, 1, command)
+		require.Equal(t, messageField{title: "Host", value: ":desktop_computer: 1.2.3.4"}, conv.replies[0].fields[0], command)
+		require.Equal(t, messageField{title: "Pod", value: "pod-2", short: true}, conv.replies[0].fields[1], command)
+	}
+}
+
+func TestCheckInHostWhichOne(t *testing.T) {
+	resetBackend()
+	for i := 0; i < 2; i++ {
+		host, _ := backend.SelectHost(context.TODO(), "pod-1")
+		backend.CheckOutHost(context.TODO(), "pod-1", host)
+	}
+
+	conv := newTestConversation("check in host")
+	CheckInHost(context.TODO(), conv)
+
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "Sorry, <@user>! There are 2 hosts checked out in pod-1. Which one should I check in? Try `check in host <name>`.", conv.replies[0].text)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+	require.True(t, isDebugHostCheckedOut("1.2.3.5"))
+}
+
+func TestCheckInUnknownHost(t *testing.T) {
+	resetBackend()
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
+
+	conv := newTestConversation("check in host 9.9.9.9")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"host": "9.9.9.9",
+	}))
+	CheckInHost(context.TODO(), conv)
+
+	require.Equal(t, "Sorry, <@user>! Looks like `9.9.9.9` isn't checked out in pod-1!", conv.replies[0].text)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
 }
 
 func TestCheckInHostAlreadyIn(t *testing.T) {
@@ -103,6 +320,33 @@ func TestCheckInHostAlreadyIn(t *testing.T) {
 	require.Equal(t, "Sorry, <@user>! Looks like there isn't a host checked out right now!", reply.text)
 }
 
+func TestCheckInHostCancelled(t *testing.T) {
+	resetBackend()
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
+
+	conv := newTestConversation("check in host")
+	CheckInHost(context.TODO(), conv)
+	clickButton(conv, "user", "cancel")
+
+	require.Len(t, conv.replies, 2)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+}
+
+func TestCheckInHostCheckedInWhileConfirming(t *testing.T) {
+	resetBackend()
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	backend.CheckOutHost(context.TODO(), "pod-1", host)
+
+	conv := newTestConversation("check in host")
+	CheckInHost(context.TODO(), conv)
+	backend.CheckInHost(context.TODO(), "pod-1", host)
+	clickButton(conv, "user", "confirm")
+
+	require.Len(t, conv.replies, 3)
+	require.Equal(t, "Sorry, <@user>! Looks like `1.2.3.4` isn't checked out in pod-1 anymore!", conv.replies[2].text)
+}
+
 func TestBaseImages(t *testing.T) {
 	resetBackend()
 
@@ -124,16 +368,47 @@ func TestRestoreBackup(t *testing.T) {
 
 	RestoreBackup(context.TODO(), conv)
 
-	require.Len(t, conv.replies, 2)
+	require.Len(t, conv.replies, 1)
+	f := messageField{title: "Image", value: "debug-base-image-2"}
+	require.Equal(t, f, conv.replies[0].fields[0])
 
-	reply := conv.replies[0]
+	clickButton(conv, "user", "confirm")
+
+	require.Len(t, conv.replies, 4)
+
+	reply := conv.replies[2]
 	require.Equal(t, "Restoring backup for <@user>…", reply.text)
 	require.True(t, reply.isAttachment)
-	f := messageField{title: "Image", value: "debug-base-image-2"}
 	require.Equal(t, f, reply.fields[0])
 
-	reply = conv.replies[1]
+	reply = conv.replies[3]
 	require.Equal(t, "Successfully restored backup for <@user>!", reply.text)
 	require.Equal(t, f, reply.fields[0])
+	require.Equal(t, messageField{title: "Pod", value: "pod-2", short: true}, reply.fields[1])
 	require.Equal(t, "good", reply.color)
 }
+
+func TestRestoreBackupInPodWithoutBackups(t *testing.T) {
+	resetBackend()
+
+	conv := newTestConversation("restore backup debug-base-image-2 in pod-1")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "debug-base-image-2",
+		"pod":   "pod-1",
+	}))
+	RestoreBackup(context.TODO(), conv)
+
+	require.Equal(t, "Sorry, <@user>! pod-1 has no backups configured, so I can't restore one there.", conv.replies[0].text)
+}
+
+func TestIsHostCheckedOutInPod(t *testing.T) {
+	resetBackend()
+	conv := newTestConversation("is checked out in pod-2")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"pod": "pod-2",
+	}))
+	IsHostCheckedOut(context.TODO(), conv)
+
+	reply := conv.replies[0]
+	require.Contains(t, reply.text, "There is no host checked out for building images in pod-2.")
+}
@@ -3,16 +3,88 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var hostSemaphore = semaphore.NewWeighted(1)
+var hostSemaphores = make(map[string]*semaphore.Weighted)
+var hostSemaphoresMu sync.Mutex
 
-// IsHostCheckedOut checks if a host is present in the dev cluster.
+// maxCheckedOutHosts is the most hosts that can be checked out of each pod at once.
+// Pods that aren't listed allow a single host.
+var maxCheckedOutHosts map[string]int
+
+var leases *LeaseStore
+var leaseConfig LeaseConfig
+
+// defaultBackupPod is where backups are restored if the user doesn't name a pod.
+var defaultBackupPod string
+
+// backupPods lists the pods that have backups configured.
+var backupPods map[string]bool
+
+// podName returns the pod the user asked for, or the default pod if they didn't specify one.
+func podName(conv Conversation) string {
+	pod := conv.String("pod")
+	if pod == "" {
+		pod = defaultPod
+	}
+
+	return pod
+}
+
+// hostSemaphore returns the semaphore that makes sure only one user at a time is checking
+// hosts in or out of a pod.
+func hostSemaphore(pod string) *semaphore.Weighted {
+	hostSemaphoresMu.Lock()
+	defer hostSemaphoresMu.Unlock()
+
+	sem, found := hostSemaphores[pod]
+	if !found {
+		sem = semaphore.NewWeighted(1)
+		hostSemaphores[pod] = sem
+	}
+
+	return sem
+}
+
+func hostLimit(pod string) int {
+	if limit, found := maxCheckedOutHosts[pod]; found {
+		return limit
+	}
+
+	return 1
+}
+
+func findHost(hosts []Host, name string) Host {
+	for _, h := range hosts {
+		if h.Name() == name {
+			return h
+		}
+	}
+
+	return nil
+}
+
+func pluralHosts(n int) string {
+	if n == 1 {
+		return "a host"
+	}
+
+	return fmt.Sprintf("%d hosts", n)
+}
+
+// IsHostCheckedOut lists the hosts that are present in the dev cluster, along with who
+// checked them out and when their leases expire.
 func IsHostCheckedOut(ctx context.Context, conv Conversation) {
-	isCheckedOut, err := backend.IsHostCheckedOut(ctx)
+	pod := podName(conv)
+	hosts, err := backend.CheckedOutHosts(ctx, pod)
 	if err != nil {
 		ReplyTo(conv).
 			ErrorText("I couldn't determine if a host is checked out already.").
@@ -20,105 +92,348 @@ func IsHostCheckedOut(ctx context.Context, conv Conversation) {
 		return
 	}
 
-	if isCheckedOut {
-		ReplyTo(conv).Text(":white_check_mark: There is a host currently checked out for building images.").Send()
-	} else {
-		ReplyTo(conv).Text(":heavy_multiplication_x: There is no host checked out for building images.").Send()
+	switch len(hosts) {
+	case 0:
+		ReplyTo(conv).Text(":heavy_multiplication_x: There is no host checked out for building images in %s.", pod).Send()
+	case 1:
+		msg := ReplyTo(conv).Text(":white_check_mark: There is a host currently checked out for building images in %s.", pod)
+		addHostFields(msg, pod, hosts)
+		msg.Send()
+	default:
+		msg := ReplyTo(conv).Text(":white_check_mark: There are %d hosts currently checked out for building images in %s.", len(hosts), pod)
+		addHostFields(msg, pod, hosts)
+		msg.Send()
 	}
 }
 
-// CheckOutHost chooses an available host in the production cluster and moves it to the dev
-// cluster.
+func addHostFields(msg *MessageBuilder, pod string, hosts []Host) {
+	for _, h := range hosts {
+		msg.Field("Host", ":desktop_computer: %s", h.Name())
+		if l, found := leases.Get(pod, h.Name()); found {
+			msg.ShortField("Owner", "<@%s>", l.Owner).
+				ShortField("Lease", "Expires %s", humanize.Time(l.ExpiresAt))
+		}
+	}
+}
+
+// CheckOutHost chooses available hosts in the production cluster and moves them to the dev
+// cluster. Users can ask for more than one host, but each pod has a limit on how many hosts
+// can be checked out at once.
+//
+// If checking out the hosts would go over the limit, it informs the user who asked. Only one
+// user can attempt to check out/in hosts in a pod at a time: other users will get an error
+// message when they try.
 //
-// If there is already a host in the dev cluster, it informs the user who asked. Only one user can
-// attempt to check out/in a host at a time: other users will get an error message when they try.
+// The user who checked out a host gets a lease on it, which expires after the duration they
+// asked for, or the default lease duration. Once the lease expires, the host is checked back in.
 func CheckOutHost(ctx context.Context, conv Conversation) {
-	isCheckedOut, err := backend.IsHostCheckedOut(ctx)
-	if err != nil {
-		ReplyTo(conv).ErrorText("I couldn't determine if a host is currently checked out.").Error(err).Send()
+	pod := podName(conv)
+	count, ok := hostCount(conv)
+	if !ok {
 		return
 	}
 
-	if isCheckedOut {
-		ReplyTo(conv).ErrorText("Looks like there's already a host checked out for building images!").Send()
+	duration, ok := leaseDuration(conv)
+	if !ok {
 		return
 	}
 
-	canCheckOut := hostSemaphore.TryAcquire(1)
+	sem := hostSemaphore(pod)
+	canCheckOut := sem.TryAcquire(1)
 	if !canCheckOut {
 		ReplyTo(conv).ErrorText("Someone is already trying to check in/out a host right now, try again later!").Send()
 		return
 	}
-	defer hostSemaphore.Release(1)
+	defer sem.Release(1)
+
+	hosts, err := backend.CheckedOutHosts(ctx, pod)
+	if err != nil {
+		ReplyTo(conv).ErrorText("I couldn't determine if a host is currently checked out.").Error(err).Send()
+		return
+	}
+
+	limit := hostLimit(pod)
+	if len(hosts)+count > limit {
+		if len(hosts) == 0 {
+			ReplyTo(conv).ErrorText("Only %d can be checked out in %s at once!", limit, pod).Send()
+		} else {
+			ReplyTo(conv).ErrorText("Looks like there's already %s checked out for building images in %s, and only %d can be checked out at once!",
+				pluralHosts(len(hosts)), pod, limit).Send()
+		}
+		return
+	}
+
+	ctx, op, done := operations.Start(ctx, conv, fmt.Sprintf("check out %s in %s", pluralHosts(count), pod))
+	defer done()
 
 	// Choosing a host can take a little time, so this message makes the bot more responsive
-	msg := ReplyTo(conv).AttachText("Choosing a host to check out for <@%s>…", conv.User()).Send()
+	msg := ReplyTo(conv).AttachText("Choosing a host to check out for <@%s>…", conv.User()).
+		ShortField("Pod", pod).
+		Footer(fmt.Sprintf("Operation %d", op.ID), op.StartedAt).
+		InThread().
+		Send()
 
-	host, err := backend.SelectHost(ctx)
-	if err != nil {
-		ReplyTo(conv).ErrorText("I couldn't choose a host to check out.").Error(err).Send()
+	var checkedOut []Host
+	for i := 0; i < count; i++ {
+		if op.reportCancelled(msg) {
+			break
+		}
+
+		host, err := backend.SelectHost(ctx, pod)
+		if err != nil {
+			if op.reportCancelled(msg) {
+				break
+			}
+			ReplyTo(conv).ErrorText("I couldn't choose a host to check out.").Error(err).Broadcast().Send()
+			break
+		}
+
+		// Similarly, actually checking out the host takes forever!
+		// Half the point of doing this with a bot is so you can get notified when it's done after
+		// you inevitably step away from your machine.
+		if count == 1 {
+			msg.AttachText("Checking out host for <@%s>…", conv.User())
+		} else {
+			msg.AttachText("Checking out host %d of %d for <@%s>…", i+1, count, conv.User())
+		}
+		msg.ClearFields().
+			Field("Host", ":desktop_computer: %s", host.Name()).
+			ShortField("Pod", pod).
+			Send()
+
+		err = backend.CheckOutHost(TrackProgress(ctx, msg), pod, host)
+		if err != nil {
+			if op.reportCancelled(msg) {
+				break
+			}
+			ReplyTo(conv).ErrorText("I couldn't check out the host.").Error(err).Field("Host", ":desktop_computer: %s", host.Name()).Broadcast().Send()
+			break
+		}
+
+		now := time.Now()
+		lease := Lease{
+			Pod:          pod,
+			Host:         host.Name(),
+			Owner:        conv.User(),
+			Channel:      conv.Channel(),
+			CheckedOutAt: now,
+			ExpiresAt:    now.Add(duration),
+		}
+		if err := leases.Put(lease); err != nil {
+			log.WithError(err).WithField("host", host.Name()).Error("could not save lease")
+		}
+
+		checkedOut = append(checkedOut, host)
+	}
+
+	if len(checkedOut) == 0 {
 		return
 	}
 
-	// Similarly, actually checking out the host takes forever!
-	// Half the point of doing this with a bot is so you can get notified when it's done after
-	// you inevitably step away from your machine.
-	msg.AttachText("Checking out host for <@%s>…", conv.User()).
-		Field("Host", ":desktop_computer: %s", host.Name()).
+	reply := ReplyTo(conv)
+	switch {
+	case count == 1:
+		reply.Text("Successfully checked out host for <@%s>!", conv.User())
+	case len(checkedOut) == count:
+		reply.Text("Successfully checked out %d hosts for <@%s>!", count, conv.User())
+	default:
+		reply.Text("Checked out %d of %d hosts for <@%s>.", len(checkedOut), count, conv.User())
+	}
+	for _, host := range checkedOut {
+		reply.Field("Host", ":desktop_computer: %s", host.Name())
+	}
+	reply.ShortField("Pod", pod).
+		ShortField("Lease", "%s", duration).
+		Color("good").
+		Broadcast().
 		Send()
+}
 
-	err = backend.CheckOutHost(ctx, host)
-	if err != nil {
-		ReplyTo(conv).ErrorText("I couldn't check out the host.").Error(err).Send()
+// hostCount returns how many hosts the user asked to check out, or 1 if they didn't say.
+// If the count isn't valid, it tells the user why and returns false.
+func hostCount(conv Conversation) (int, bool) {
+	s := conv.String("count")
+	if s == "" {
+		return 1, true
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		ReplyTo(conv).ErrorText("I don't know how to check out `%s` hosts.", s).Send()
+		return 0, false
+	}
+
+	return n, true
+}
+
+// leaseDuration returns how long the user asked to keep a host, or the default lease
+// duration if they didn't say. If the duration isn't valid, it tells the user why and
+// returns false.
+func leaseDuration(conv Conversation) (time.Duration, bool) {
+	s := conv.String("duration")
+	if s == "" {
+		return leaseConfig.Default, true
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		ReplyTo(conv).ErrorText("I don't understand how long `%s` is. Try something like `4h` or `90m`.", s).Send()
+		return 0, false
+	}
+	if d > leaseConfig.Max {
+		ReplyTo(conv).ErrorText("You can only check out a host for up to %s at a time.", leaseConfig.Max).Send()
+		return 0, false
+	}
+
+	return d, true
+}
+
+// ExtendLease adds time to the leases of the hosts the user has checked out.
+//
+// Leases can't be extended further than the maximum lease duration from now.
+func ExtendLease(ctx context.Context, conv Conversation) {
+	owned := leases.ForOwner(conv.User())
+	if len(owned) == 0 {
+		ReplyTo(conv).ErrorText("You don't have any hosts checked out right now!").Send()
 		return
 	}
 
-	ReplyTo(conv).
-		Text("Successfully checked out host for <@%s>!", conv.User()).
-		Field("Host", ":desktop_computer: %s", host.Name()).
-		Color("good").Send()
+	duration, ok := leaseDuration(conv)
+	if !ok {
+		return
+	}
+
+	limit := time.Now().Add(leaseConfig.Max)
+	msg := ReplyTo(conv).AttachText("Extended lease for <@%s>.", conv.User()).Color("good")
+	for _, l := range owned {
+		l, found, err := leases.Update(l.Pod, l.Host, func(l *Lease) {
+			l.ExpiresAt = l.ExpiresAt.Add(duration)
+			if l.ExpiresAt.After(limit) {
+				l.ExpiresAt = limit
+			}
+			l.Warned = false
+		})
+		if err != nil {
+			ReplyTo(conv).ErrorText("I couldn't extend your lease.").Error(err).Send()
+			return
+		}
+		if !found {
+			// The host was checked in since we looked
+			continue
+		}
+
+		msg.Field("Host", ":desktop_computer: %s", l.Host).
+			ShortField("Pod", l.Pod).
+			ShortField("Lease", "Expires %s", humanize.Time(l.ExpiresAt))
+	}
+
+	msg.Send()
 }
 
 // CheckInHost moves a host from the dev cluster to the production cluster.
 //
-// If there is no host in the dev cluster, it informs the user who asked.
+// The user can name the host to check in. If they don't, and there is only one host in the dev
+// cluster, that host is checked in. If there is no host in the dev cluster, or the named host
+// isn't in it, it informs the user who asked.
+//
+// The user has to confirm before the host is checked in.
 func CheckInHost(ctx context.Context, conv Conversation) {
-	isCheckedOut, err := backend.IsHostCheckedOut(ctx)
+	pod := podName(conv)
+	name := conv.String("host")
+
+	hosts, err := backend.CheckedOutHosts(ctx, pod)
 	if err != nil {
 		ReplyTo(conv).ErrorText("I couldn't determine if a host is currently checked out.").Error(err).Send()
 		return
 	}
 
-	if !isCheckedOut {
+	if len(hosts) == 0 {
 		ReplyTo(conv).ErrorText("Looks like there isn't a host checked out right now!").Send()
 		return
 	}
 
-	canCheckOut := hostSemaphore.TryAcquire(1)
-	if !canCheckOut {
-		ReplyTo(conv).ErrorText("Someone is already trying to check in/out a host right now, try again later!").Send()
+	if name == "" {
+		if len(hosts) > 1 {
+			msg := ReplyTo(conv).ErrorText("There are %d hosts checked out in %s. Which one should I check in? Try `check in host <name>`.", len(hosts), pod)
+			addHostFields(msg, pod, hosts)
+			msg.Send()
+			return
+		}
+		name = hosts[0].Name()
+	} else if findHost(hosts, name) == nil {
+		ReplyTo(conv).ErrorText("Looks like `%s` isn't checked out in %s!", name, pod).Send()
 		return
 	}
-	defer hostSemaphore.Release(1)
 
-	ReplyTo(conv).AttachText("Checking the host in for <@%s>…", conv.User()).Send()
+	msg := ReplyTo(conv).
+		AttachText("<@%s>, are you sure you want to check in this host? Any image builds running on it will be interrupted.", conv.User()).
+		Field("Host", ":desktop_computer: %s", name).
+		ShortField("Pod", pod)
+	if l, found := leases.Get(pod, name); found {
+		msg.ShortField("Owner", "<@%s>", l.Owner)
+	}
+
+	Confirm(conv, msg, func(ctx context.Context) {
+		checkInHost(ctx, conv, pod, name)
+	})
+}
 
-	host, err := backend.CheckInHost(ctx)
+func checkInHost(ctx context.Context, conv Conversation, pod string, name string) {
+	sem := hostSemaphore(pod)
+	canCheckIn := sem.TryAcquire(1)
+	if !canCheckIn {
+		ReplyTo(conv).ErrorText("Someone is already trying to check in/out a host right now, try again later!").Send()
+		return
+	}
+	defer sem.Release(1)
+
+	// The host may have been checked in while we were waiting for confirmation
+	hosts, err := backend.CheckedOutHosts(ctx, pod)
 	if err != nil {
-		ReplyTo(conv).ErrorText("I couldn't check the host back in.").Error(err).Send()
+		ReplyTo(conv).ErrorText("I couldn't determine if a host is currently checked out.").Error(err).Send()
+		return
+	}
+
+	host := findHost(hosts, name)
+	if host == nil {
+		ReplyTo(conv).ErrorText("Looks like `%s` isn't checked out in %s anymore!", name, pod).Send()
+		return
+	}
+
+	ctx, op, done := operations.Start(ctx, conv, fmt.Sprintf("check in %s in %s", host.Name(), pod))
+	defer done()
+
+	msg := ReplyTo(conv).AttachText("Checking the host in for <@%s>…", conv.User()).
+		Field("Host", ":desktop_computer: %s", host.Name()).
+		ShortField("Pod", pod).
+		Footer(fmt.Sprintf("Operation %d", op.ID), op.StartedAt).
+		InThread().
+		Send()
+
+	if err := backend.CheckInHost(TrackProgress(ctx, msg), pod, host); err != nil {
+		if op.reportCancelled(msg) {
+			return
+		}
+		ReplyTo(conv).ErrorText("I couldn't check the host back in.").Error(err).Broadcast().Send()
 		return
 	}
 
+	if err := leases.Delete(pod, host.Name()); err != nil {
+		log.WithError(err).WithField("host", host.Name()).Error("could not delete lease")
+	}
+
 	ReplyTo(conv).
 		AttachText("Successfully checked in host for <@%s>!", conv.User()).
 		Color("good").
 		Field("Host", ":desktop_computer: %s", host.Name()).
+		ShortField("Pod", pod).
+		Broadcast().
 		Send()
 }
 
 // BaseImages lists the names of the base VM images that are in the datacenter.
 func BaseImages(ctx context.Context, conv Conversation) {
-	images, err := backend.BaseImages(ctx)
+	images, err := backend.BaseImages(ctx, podName(conv))
 	if err != nil {
 		ReplyTo(conv).ErrorText("I couldn't get the list of base images.").Error(err).Send()
 		return
@@ -135,15 +450,51 @@ func BaseImages(ctx context.Context, conv Conversation) {
 }
 
 // RestoreBackup copies a backup image into the place of a production base image.
+//
+// The user has to confirm before the backup is restored, since it overwrites the base image.
 func RestoreBackup(ctx context.Context, conv Conversation) {
 	image := conv.String("image")
-	ReplyTo(conv).
+	pod := conv.String("pod")
+	if pod == "" {
+		pod = defaultBackupPod
+	}
+
+	if pod == "" {
+		ReplyTo(conv).ErrorText("No pod has backups configured, so I can't restore one.").Send()
+		return
+	}
+	if !backupPods[pod] {
+		ReplyTo(conv).ErrorText("%s has no backups configured, so I can't restore one there.", pod).Send()
+		return
+	}
+
+	msg := ReplyTo(conv).
+		AttachText("<@%s>, are you sure you want to restore this backup? It will replace the production base image.", conv.User()).
+		Field("Image", image).
+		ShortField("Pod", pod)
+
+	Confirm(conv, msg, func(ctx context.Context) {
+		restoreBackup(ctx, conv, pod, image)
+	})
+}
+
+func restoreBackup(ctx context.Context, conv Conversation, pod string, image string) {
+	ctx, op, done := operations.Start(ctx, conv, fmt.Sprintf("restore backup %s in %s", image, pod))
+	defer done()
+
+	msg := ReplyTo(conv).
 		AttachText("Restoring backup for <@%s>…", conv.User()).
 		Field("Image", image).
+		ShortField("Pod", pod).
+		Footer(fmt.Sprintf("Operation %d", op.ID), op.StartedAt).
+		InThread().
 		Send()
 
-	if err := backend.RestoreBackup(ctx, image); err != nil {
-		ReplyTo(conv).ErrorText("I couldn't restore that backup.").Error(err).Send()
+	if err := backend.RestoreBackup(TrackProgress(ctx, msg), pod, image); err != nil {
+		if op.reportCancelled(msg) {
+			return
+		}
+		ReplyTo(conv).ErrorText("I couldn't restore that backup.").Error(err).Broadcast().Send()
 		return
 	}
 
@@ -151,6 +502,8 @@ func RestoreBackup(ctx context.Context, conv Conversation) {
 		AttachText("Successfully restored backup for <@%s>!", conv.User()).
 		Color("good").
 		Field("Image", image).
+		ShortField("Pod", pod).
+		Broadcast().
 		Send()
 }
 
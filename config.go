@@ -0,0 +1,558 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config describes the datacenters and services that macbot talks to.
+//
+// It is usually loaded from a YAML file passed with the -config flag. Secrets can be
+// left out of the file and provided through environment variables instead.
+type Config struct {
+	DefaultPod string                     `yaml:"default_pod"`
+	Pods       map[string]*PodConfig      `yaml:"pods"`
+	JobBoards  map[string]*JobBoardConfig `yaml:"job_boards"`
+	Imaged     ImagedConfig               `yaml:"imaged"`
+	Leases     LeaseConfig                `yaml:"leases"`
+	Slack      SlackConfig                `yaml:"slack"`
+	HTTP       HTTPConfig                 `yaml:"http"`
+
+	// Roles maps role names to the users who have them. If no roles are configured,
+	// everyone can run every command.
+	Roles map[string]*RoleConfig `yaml:"roles"`
+
+	// ConfirmTimeout is how long users have to confirm destructive commands.
+	ConfirmTimeout time.Duration `yaml:"confirm_timeout"`
+	// ApprovalTimeout is how long changes wait for someone to approve them.
+	ApprovalTimeout time.Duration `yaml:"approval_timeout"`
+	// ShutdownTimeout is how long the bot waits for running commands to finish when it is
+	// asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// StateDir is where macbot keeps state that should survive restarts, like host leases.
+	StateDir string `yaml:"state_dir"`
+
+	// DefaultBackupPod is where backups are restored if the user doesn't name a pod. It
+	// defaults to the default pod if that has backups, or else the first pod that does.
+	DefaultBackupPod string `yaml:"default_backup_pod"`
+}
+
+// PodConfig describes one of our vSphere datacenters and where to find things in it.
+type PodConfig struct {
+	URL             string `yaml:"url"`
+	Insecure        bool   `yaml:"insecure"`
+	ProdClusterPath string `yaml:"prod_cluster_path"`
+	DevClusterPath  string `yaml:"dev_cluster_path"`
+	BaseImagePath   string `yaml:"base_image_path"`
+	BackupImagePath string `yaml:"backup_image_path"`
+	DatastorePath   string `yaml:"datastore_path"`
+
+	// MaxCheckedOutHosts is how many hosts can be in the dev cluster at once.
+	MaxCheckedOutHosts int `yaml:"max_checked_out_hosts"`
+
+	// KeepUnusedBaseImages is how many of the newest unused base VMs of each template are
+	// kept when deleting unused base VMs, so there's something to roll back to.
+	KeepUnusedBaseImages int `yaml:"keep_unused_base_images"`
+}
+
+// JobBoardConfig describes how to reach the job board for an environment.
+type JobBoardConfig struct {
+	URL      string `yaml:"url"`
+	Password string `yaml:"password"`
+
+	// Infra is the infrastructure whose images are managed, unless a command names another.
+	Infra string `yaml:"infra"`
+
+	// Pod is where the base VMs registered in this job board live, so that image names can
+	// be checked before they're registered. Defaults to the default pod.
+	Pod string `yaml:"pod"`
+
+	// RequireApproval makes changes to this job board wait for a second person to approve them.
+	RequireApproval bool `yaml:"require_approval"`
+}
+
+// ImagedConfig describes how to reach imaged.
+type ImagedConfig struct {
+	URL string `yaml:"url"`
+}
+
+// Ways the bot can receive messages from Slack.
+const (
+	// slackModeRTM connects to Slack's Real Time Messaging API over a websocket.
+	slackModeRTM = "rtm"
+	// slackModeEvents receives Events API callbacks and slash commands over HTTP.
+	slackModeEvents = "events"
+)
+
+// SlackConfig holds settings for talking to Slack.
+type SlackConfig struct {
+	// Mode is how the bot receives messages, either "rtm" or "events".
+	Mode string `yaml:"mode"`
+	// SigningSecret is used to verify that requests to our HTTP endpoints came from Slack.
+	// It's only needed if the bot serves the events or actions endpoint.
+	SigningSecret string `yaml:"signing_secret"`
+	// DisableActions stops the bot from serving button clicks at /slack/actions, for an
+	// RTM-only setup without an interactivity Request URL. Nothing can be confirmed or
+	// approved then.
+	DisableActions bool `yaml:"disable_actions"`
+	// MaxReconnects is how many times in a row reconnecting to the RTM API can fail before
+	// the bot gives up and exits.
+	MaxReconnects int `yaml:"max_reconnects"`
+}
+
+// HTTPConfig controls the HTTP server that receives requests from Slack.
+type HTTPConfig struct {
+	// Listen is the address to listen on, like ":8080".
+	Listen string `yaml:"listen"`
+}
+
+// RoleConfig lists who has a role. Users and groups are Slack IDs, like U012AB3CD for a
+// user or S0614TZR7 for a user group.
+type RoleConfig struct {
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+}
+
+// LeaseConfig controls how long users can keep hosts checked out.
+type LeaseConfig struct {
+	// Default is how long a host is leased for if the user doesn't ask for a duration,
+	// and how much time extending a lease adds.
+	Default time.Duration `yaml:"default"`
+	// Max is the longest lease a user can ask for at once.
+	Max time.Duration `yaml:"max"`
+	// Warning is how long before a lease expires its owner is reminded about it.
+	Warning time.Duration `yaml:"warning"`
+}
+
+// ConfigError collects every problem found while validating a config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// LoadConfig reads the config file at path and applies overrides from the environment.
+//
+// If path is empty, the default config is used instead, which matches our MacStadium
+// datacenter and takes the job board and imaged URLs from the environment.
+func LoadConfig(path string, getenv func(string) string) (*Config, error) {
+	var cfg *Config
+	if path == "" {
+		cfg = defaultConfig(getenv)
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err = parseConfig(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.applyEnv(getenv)
+	return cfg, nil
+}
+
+// applyDefaults fills in settings that were left out of the config.
+func (c *Config) applyDefaults() {
+	if c.StateDir == "" {
+		c.StateDir = "."
+	}
+	for _, pod := range c.Pods {
+		if pod != nil && pod.MaxCheckedOutHosts == 0 {
+			pod.MaxCheckedOutHosts = 1
+		}
+		if pod != nil && pod.KeepUnusedBaseImages == 0 {
+			pod.KeepUnusedBaseImages = defaultKeepUnusedBaseImages
+		}
+	}
+	for _, jb := range c.JobBoards {
+		if jb != nil && jb.Infra == "" {
+			jb.Infra = defaultJobBoardInfra
+		}
+	}
+	if c.HTTP.Listen == "" {
+		c.HTTP.Listen = ":8080"
+	}
+	if c.Slack.Mode == "" {
+		c.Slack.Mode = slackModeRTM
+	}
+	if c.Slack.MaxReconnects == 0 {
+		c.Slack.MaxReconnects = 20
+	}
+	if c.ApprovalTimeout == 0 {
+		c.ApprovalTimeout = time.Hour
+	}
+	if c.ConfirmTimeout == 0 {
+		c.ConfirmTimeout = 5 * time.Minute
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 10 * time.Minute
+	}
+	if c.Leases.Default == 0 {
+		c.Leases.Default = 8 * time.Hour
+	}
+	if c.Leases.Max == 0 {
+		c.Leases.Max = 72 * time.Hour
+	}
+	if c.Leases.Warning == 0 {
+		c.Leases.Warning = 30 * time.Minute
+	}
+	if c.DefaultBackupPod == "" {
+		c.DefaultBackupPod = c.firstBackupPod()
+	}
+}
+
+// StatePath returns the path of a file in the state directory.
+func (c *Config) StatePath(name string) string {
+	return filepath.Join(c.StateDir, name)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.applyDefaults()
+	return &cfg, nil
+}
+
+func defaultConfig(getenv func(string) string) *Config {
+	cfg := &Config{
+		DefaultPod: "pod-1",
+		Pods: map[string]*PodConfig{
+			"pod-1": {
+				Insecure:        true,
+				ProdClusterPath: "/pod-1/host/MacPro_Pod_1",
+				DevClusterPath:  "/pod-1/host/packer_image_dev",
+				BaseImagePath:   "/pod-1/vm/Base VMs",
+			},
+			"pod-2": {
+				Insecure:        true,
+				ProdClusterPath: "/pod-2/host/MacPro_Pod_2",
+				BaseImagePath:   "/pod-2/vm/Base VMs",
+				BackupImagePath: "/pod-2/vm/VM Backups",
+				DatastorePath:   "/pod-2/datastore/DataCore1_4",
+			},
+		},
+		JobBoards: make(map[string]*JobBoardConfig),
+	}
+
+	for _, env := range []string{"production", "staging"} {
+		if getenv(envName("MACBOT_JOB_BOARD", env, "URL")) != "" {
+			cfg.JobBoards[env] = &JobBoardConfig{
+				RequireApproval: env == "production",
+			}
+		}
+	}
+
+	cfg.applyDefaults()
+	return cfg
+}
+
+// applyEnv overrides URLs and secrets in the config with values from the environment.
+//
+// For a pod named "pod-1", VSPHERE_POD1_URL replaces the vSphere URL (which includes
+// the credentials). For a job board named "production", MACBOT_JOB_BOARD_PRODUCTION_URL
+// and MACBOT_JOB_BOARD_PRODUCTION_PASSWORD replace the URL and password.
+// MACBOT_IMAGED_URL replaces the imaged URL, SLACK_SIGNING_SECRET replaces the Slack
+// signing secret, and MACBOT_SLACK_MODE replaces how the bot receives messages.
+func (c *Config) applyEnv(getenv func(string) string) {
+	for name, pod := range c.Pods {
+		if pod == nil {
+			continue
+		}
+		if v := getenv(envName("VSPHERE", name, "URL")); v != "" {
+			pod.URL = v
+		}
+	}
+
+	for name, jb := range c.JobBoards {
+		if jb == nil {
+			continue
+		}
+		if v := getenv(envName("MACBOT_JOB_BOARD", name, "URL")); v != "" {
+			jb.URL = v
+		}
+		if v := getenv(envName("MACBOT_JOB_BOARD", name, "PASSWORD")); v != "" {
+			jb.Password = v
+		}
+	}
+
+	if v := getenv("MACBOT_IMAGED_URL"); v != "" {
+		c.Imaged.URL = v
+	}
+
+	if v := getenv("SLACK_SIGNING_SECRET"); v != "" {
+		c.Slack.SigningSecret = v
+	}
+	if v := getenv("MACBOT_SLACK_MODE"); v != "" {
+		c.Slack.Mode = v
+	}
+}
+
+// envName builds an environment variable name for a named pod or job board,
+// turning a name like "pod-1" into "POD1".
+func envName(prefix, name, suffix string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+
+	return prefix + "_" + b.String() + "_" + suffix
+}
+
+// Validate checks the config for problems, returning a *ConfigError that lists all
+// of them if there are any.
+//
+// In debug mode, the bot doesn't talk to vSphere or job board, so pods and job boards don't
+// need a URL, and requests from Slack don't need to be signed.
+func (c *Config) Validate(debug bool) error {
+	errs := &ConfigError{}
+
+	if len(c.Pods) == 0 {
+		errs.add("no pods are configured")
+	} else if _, found := c.Pods[c.DefaultPod]; !found {
+		errs.add("default pod %q is not one of the configured pods", c.DefaultPod)
+	}
+
+	if c.DefaultBackupPod != "" {
+		if pod, found := c.Pods[c.DefaultBackupPod]; !found || pod == nil {
+			errs.add("default backup pod %q is not one of the configured pods", c.DefaultBackupPod)
+		} else if pod.BackupImagePath == "" {
+			errs.add("default backup pod %s: backup_image_path is required to restore backups", c.DefaultBackupPod)
+		}
+	}
+
+	for _, name := range c.PodNames() {
+		pod := c.Pods[name]
+		if pod == nil {
+			errs.add("pod %s: missing configuration", name)
+			continue
+		}
+
+		if pod.URL == "" {
+			if !debug {
+				errs.add("pod %s: url is required (or set %s)", name, envName("VSPHERE", name, "URL"))
+			}
+		} else if _, err := url.Parse(pod.URL); err != nil {
+			errs.add("pod %s: could not parse url: %v", name, err)
+		}
+
+		if pod.ProdClusterPath == "" {
+			errs.add("pod %s: prod_cluster_path is required", name)
+		}
+		if pod.BaseImagePath == "" {
+			errs.add("pod %s: base_image_path is required", name)
+		}
+		if pod.BackupImagePath != "" && pod.DatastorePath == "" {
+			errs.add("pod %s: datastore_path is required to restore backups", name)
+		}
+		if pod.MaxCheckedOutHosts < 0 {
+			errs.add("pod %s: max_checked_out_hosts can't be negative", name)
+		}
+		if pod.KeepUnusedBaseImages < 0 {
+			errs.add("pod %s: keep_unused_base_images can't be negative", name)
+		}
+	}
+
+	for _, name := range c.JobBoardNames() {
+		jb := c.JobBoards[name]
+		if jb == nil {
+			errs.add("job board %s: missing configuration", name)
+			continue
+		}
+
+		if jb.URL == "" {
+			if !debug {
+				errs.add("job board %s: url is required (or set %s)", name, envName("MACBOT_JOB_BOARD", name, "URL"))
+			}
+		} else if _, err := url.Parse(jb.URL); err != nil {
+			errs.add("job board %s: could not parse url: %v", name, err)
+		}
+		if jb.Password == "" && !debug {
+			errs.add("job board %s: password is required (or set %s)", name, envName("MACBOT_JOB_BOARD", name, "PASSWORD"))
+		}
+		if _, found := c.Pods[jb.Pod]; jb.Pod != "" && !found {
+			errs.add("job board %s: pod %q is not one of the configured pods", name, jb.Pod)
+		}
+	}
+
+	if c.Imaged.URL == "" {
+		errs.add("imaged: url is required (or set MACBOT_IMAGED_URL)")
+	}
+
+	if c.Slack.Mode != slackModeRTM && c.Slack.Mode != slackModeEvents {
+		errs.add("slack: mode must be %q or %q, not %q", slackModeRTM, slackModeEvents, c.Slack.Mode)
+	}
+	if c.Slack.MaxReconnects < 0 {
+		errs.add("slack: max_reconnects can't be negative")
+	}
+	if c.Slack.SigningSecret == "" && !debug && (c.Slack.Mode == slackModeEvents || !c.Slack.DisableActions) {
+		errs.add("slack: signing_secret is required (or set SLACK_SIGNING_SECRET)")
+	}
+
+	for _, name := range c.RoleNames() {
+		role := c.Roles[name]
+		if role == nil || len(role.Users)+len(role.Groups) == 0 {
+			errs.add("role %s: at least one user or group is required", name)
+		}
+	}
+
+	if c.Leases.Default > c.Leases.Max {
+		errs.add("leases: default (%s) is longer than max (%s)", c.Leases.Default, c.Leases.Max)
+	}
+	if c.Leases.Warning >= c.Leases.Default {
+		errs.add("leases: warning (%s) must be shorter than default (%s)", c.Leases.Warning, c.Leases.Default)
+	}
+
+	if len(errs.Problems) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Datacenters converts the pod configs into the form used by the vSphere backend.
+//
+// The config should be validated first.
+func (c *Config) Datacenters() map[string]DatacenterConfig {
+	datacenters := make(map[string]DatacenterConfig)
+	for name, pod := range c.Pods {
+		u, _ := url.Parse(pod.URL)
+		datacenters[name] = DatacenterConfig{
+			URL:             u,
+			Insecure:        pod.Insecure,
+			ProdClusterPath: pod.ProdClusterPath,
+			DevClusterPath:  pod.DevClusterPath,
+			BaseImagePath:   pod.BaseImagePath,
+			BackupImagePath: pod.BackupImagePath,
+			DatastorePath:   pod.DatastorePath,
+		}
+	}
+
+	return datacenters
+}
+
+// HostLimits returns how many hosts can be checked out of each pod at once.
+func (c *Config) HostLimits() map[string]int {
+	limits := make(map[string]int)
+	for name, pod := range c.Pods {
+		limits[name] = pod.MaxCheckedOutHosts
+	}
+
+	return limits
+}
+
+// UnusedBaseImagesToKeep returns how many unused base VMs of each template are kept in each
+// pod.
+func (c *Config) UnusedBaseImagesToKeep() map[string]int {
+	keep := make(map[string]int)
+	for name, pod := range c.Pods {
+		keep[name] = pod.KeepUnusedBaseImages
+	}
+
+	return keep
+}
+
+// ApprovalRequired returns which job board environments need changes to be approved.
+func (c *Config) ApprovalRequired() map[string]bool {
+	required := make(map[string]bool)
+	for name, jb := range c.JobBoards {
+		required[name] = jb.RequireApproval
+	}
+
+	return required
+}
+
+// JobBoardPods returns the pod each job board environment's base VMs live in, for the
+// environments that name one.
+func (c *Config) JobBoardPods() map[string]string {
+	pods := make(map[string]string)
+	for name, jb := range c.JobBoards {
+		if jb.Pod != "" {
+			pods[name] = jb.Pod
+		}
+	}
+
+	return pods
+}
+
+// firstBackupPod picks the pod backups are restored to by default: the default pod if it
+// has backups, or else the first pod that does. It returns an empty string if no pod has
+// backups.
+func (c *Config) firstBackupPod() string {
+	if pod := c.Pods[c.DefaultPod]; pod != nil && pod.BackupImagePath != "" {
+		return c.DefaultPod
+	}
+
+	for _, name := range c.PodNames() {
+		if pod := c.Pods[name]; pod != nil && pod.BackupImagePath != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// BackupPods returns which pods have backups that can be restored.
+func (c *Config) BackupPods() map[string]bool {
+	pods := make(map[string]bool)
+	for name, pod := range c.Pods {
+		if pod != nil && pod.BackupImagePath != "" {
+			pods[name] = true
+		}
+	}
+
+	return pods
+}
+
+// PodNames returns the names of the configured pods in sorted order.
+func (c *Config) PodNames() []string {
+	var names []string
+	for name := range c.Pods {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// JobBoardNames returns the names of the configured job board environments in sorted order.
+func (c *Config) JobBoardNames() []string {
+	var names []string
+	for name := range c.JobBoards {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// RoleNames returns the names of the configured roles in sorted order.
+func (c *Config) RoleNames() []string {
+	var names []string
+	for name := range c.Roles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
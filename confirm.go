@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var confirmations = NewConfirmations(5 * time.Minute)
+
+// Confirmations keeps track of actions that are waiting for the user who asked for them to
+// confirm them.
+type Confirmations struct {
+	// Timeout is how long a user has to confirm an action before it expires.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingConfirmation
+}
+
+type pendingConfirmation struct {
+	conv  Conversation
+	msg   *MessageBuilder
+	text  string
+	fn    func(context.Context)
+	timer *time.Timer
+}
+
+// NewConfirmations creates an empty set of confirmations that expire after the timeout.
+func NewConfirmations(timeout time.Duration) *Confirmations {
+	return &Confirmations{
+		Timeout: timeout,
+		pending: make(map[string]*pendingConfirmation),
+	}
+}
+
+// Confirm asks the user who started the conversation to confirm an action before it runs.
+//
+// The message is sent with Confirm and Cancel buttons. If the user clicks Confirm before the
+// confirmation expires, the buttons are removed and fn runs. If they click Cancel, or don't
+// click anything in time, fn never runs and the message is updated to say so.
+func Confirm(conv Conversation, msg *MessageBuilder, fn func(context.Context)) {
+	confirmations.Confirm(conv, msg, fn)
+}
+
+// Confirm asks the user who started the conversation to confirm an action before it runs.
+func (c *Confirmations) Confirm(conv Conversation, msg *MessageBuilder, fn func(context.Context)) {
+	id := randomID()
+	p := &pendingConfirmation{
+		conv: conv,
+		msg:  msg,
+		text: msg.text,
+		fn:   fn,
+	}
+
+	c.mu.Lock()
+	c.pending[id] = p
+	p.timer = time.AfterFunc(c.Timeout, func() {
+		c.expire(id)
+	})
+	c.mu.Unlock()
+
+	msg.CallbackID("confirm:"+id).
+		Button("confirm", "Confirm", "danger").
+		Button("cancel", "Cancel", "").
+		Send()
+}
+
+// HandleAction resolves a pending confirmation when the user who asked for it clicks one of
+// its buttons. Clicks from anyone else are ignored.
+func (c *Confirmations) HandleAction(ctx context.Context, a Action) {
+	id := strings.TrimPrefix(a.CallbackID, "confirm:")
+	entry := log.WithFields(log.Fields{
+		"confirmation": id,
+		"user":         a.User,
+	})
+
+	c.mu.Lock()
+	p, found := c.pending[id]
+	if found && p.conv.User() != a.User {
+		c.mu.Unlock()
+		entry.Warn("ignoring confirmation from a different user")
+		return
+	}
+	delete(c.pending, id)
+	c.mu.Unlock()
+
+	if !found {
+		entry.Info("ignoring action for an unknown or resolved confirmation")
+		return
+	}
+	p.timer.Stop()
+
+	switch a.Name {
+	case "confirm":
+		entry.Info("action confirmed")
+		p.resolve(":white_check_mark: Confirmed by <@%s>.", a.User)
+		auditFollowUp(p.conv, "", func() {
+			p.fn(ctx)
+		})
+	default:
+		entry.Info("action cancelled")
+		p.resolve(":no_entry_sign: Cancelled by <@%s>.", a.User)
+		auditFollowUp(p.conv, auditCancelled, nil)
+	}
+}
+
+func (c *Confirmations) expire(id string) {
+	c.mu.Lock()
+	p, found := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+
+	if found {
+		log.WithField("confirmation", id).Info("confirmation expired")
+		p.resolve(":hourglass: This wasn't confirmed in time, so I didn't do anything.")
+		auditFollowUp(p.conv, auditExpired, nil)
+	}
+}
+
+// resolve removes the buttons from the confirmation message and notes what happened to it.
+func (p *pendingConfirmation) resolve(status string, args ...interface{}) {
+	p.msg.ClearButtons().
+		Color("").
+		AttachText("%s\n"+status, append([]interface{}{p.text}, args...)...).
+		Send()
+}
+
+// randomID generates a short random identifier for tracking things like confirmations.
+func randomID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clickButton simulates a user clicking a button on the last confirmation sent in the conversation.
+func clickButton(conv *testConversation, user string, name string) {
+	var callbackID string
+	for _, reply := range conv.replies {
+		if reply.callbackID != "" {
+			callbackID = reply.callbackID
+		}
+	}
+
+	confirmations.HandleAction(context.TODO(), Action{
+		CallbackID: callbackID,
+		Name:       name,
+		User:       user,
+		Channel:    conv.Channel(),
+	})
+}
+
+func TestConfirm(t *testing.T) {
+	conv := newTestConversation("do something")
+	ran := false
+	Confirm(conv, ReplyTo(conv).AttachText("Are you sure?"), func(context.Context) {
+		ran = true
+	})
+
+	require.Len(t, conv.replies, 1)
+	reply := conv.replies[0]
+	require.Equal(t, "<@user>: Are you sure?", reply.text)
+	require.Contains(t, reply.callbackID, "confirm:")
+	require.Len(t, reply.buttons, 2)
+	require.False(t, ran)
+
+	clickButton(conv, "user", "confirm")
+
+	require.True(t, ran)
+	require.Len(t, conv.replies, 2)
+	reply = conv.replies[1]
+	require.Equal(t, "<@user>: Are you sure?\n:white_check_mark: Confirmed by <@user>.", reply.text)
+	require.Empty(t, reply.buttons)
+	require.Equal(t, "1", reply.timestamp, "expected the confirmation to be updated")
+}
+
+func TestConfirmCancel(t *testing.T) {
+	conv := newTestConversation("do something")
+	ran := false
+	Confirm(conv, ReplyTo(conv).AttachText("Are you sure?"), func(context.Context) {
+		ran = true
+	})
+
+	clickButton(conv, "user", "cancel")
+	clickButton(conv, "user", "confirm")
+
+	require.False(t, ran)
+	require.Len(t, conv.replies, 2)
+	require.Equal(t, "<@user>: Are you sure?\n:no_entry_sign: Cancelled by <@user>.", conv.replies[1].text)
+}
+
+func TestConfirmOtherUser(t *testing.T) {
+	conv := newTestConversation("do something")
+	ran := false
+	Confirm(conv, ReplyTo(conv).AttachText("Are you sure?"), func(context.Context) {
+		ran = true
+	})
+
+	clickButton(conv, "someone-else", "confirm")
+	require.False(t, ran)
+	require.Len(t, conv.replies, 1)
+
+	clickButton(conv, "user", "confirm")
+	require.True(t, ran)
+}
+
+func TestConfirmExpires(t *testing.T) {
+	c := NewConfirmations(time.Hour)
+	conv := newTestConversation("do something")
+	c.Confirm(conv, ReplyTo(conv).AttachText("Are you sure?"), func(context.Context) {
+		t.Fatal("expired confirmation should not run")
+	})
+
+	c.expire(strings.TrimPrefix(conv.replies[0].callbackID, "confirm:"))
+
+	require.Empty(t, c.pending)
+	require.Equal(t, "<@user>: Are you sure?\n:hourglass: This wasn't confirmed in time, so I didn't do anything.", conv.replies[1].text)
+}
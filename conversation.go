@@ -10,12 +10,21 @@ import (
 	"strings"
 )
 
+// slackClient is used to send messages to Slack.
+var slackClient *slack.Client
+
+// botUserID is the Slack user ID of the bot. It is looked up once when the bot starts.
+var botUserID string
+
 // Conversation provides an easy way for commands to respond to the user.
 type Conversation interface {
 	User() string
 	Channel() string
 	CommandText() string
 	IsDirectMessage() bool
+	// ThreadTimestamp returns the timestamp of the message that replies should be threaded
+	// under, or an empty string if replies can't be threaded.
+	ThreadTimestamp() string
 	Send(*MessageBuilder) string
 
 	SetProperties(*proper.Properties)
@@ -49,21 +58,29 @@ func (c *slackConversation) Channel() string {
 // If the message was not directed to the bot, either through DM or an @mention,
 // CommandText returns an empty string.
 func (c *slackConversation) CommandText() string {
-	userID := rtm.GetInfo().User.ID
 	// Ignore messages that the bot sent, no matter what
-	if c.User() == userID {
+	if c.User() == botUserID {
 		return ""
 	}
 
 	text := strings.TrimSpace(c.Event.Text)
 
-	mentionPrefix := "<@" + userID + "> "
+	mentionPrefix := "<@" + botUserID + "> "
 	if !c.IsDirectMessage() && !strings.HasPrefix(text, mentionPrefix) {
 		return ""
 	}
 
+	return commandText(text)
+}
+
+// commandText strips the bot's @mention from the start of a message, if it has one,
+// and normalizes the rest into a command.
+func commandText(text string) string {
+	text = strings.TrimSpace(text)
+
+	mentionPrefix := "<@" + botUserID + ">"
 	if strings.HasPrefix(text, mentionPrefix) {
-		text = text[len(mentionPrefix):len(text)]
+		text = text[len(mentionPrefix):]
 	}
 
 	return strings.ToLower(strings.TrimSpace(text))
@@ -74,7 +91,19 @@ func (c *slackConversation) IsDirectMessage() bool {
 	return strings.HasPrefix(c.Channel(), "D")
 }
 
+// ThreadTimestamp returns the timestamp of the user's message, or of the thread it is in.
+func (c *slackConversation) ThreadTimestamp() string {
+	if c.Event.ThreadTimestamp != "" {
+		return c.Event.ThreadTimestamp
+	}
+	return c.Event.Timestamp
+}
+
 func (c *slackConversation) Send(b *MessageBuilder) string {
+	return sendMessage(c, b)
+}
+
+func sendMessage(c Conversation, b *MessageBuilder) string {
 	log.WithFields(log.Fields{
 		"channel": c.Channel(),
 		"user":    c.User(),
@@ -82,8 +111,11 @@ func (c *slackConversation) Send(b *MessageBuilder) string {
 	}).Info("sending reply")
 
 	options := messageOptions(b)
-	// TODO: check and probably log the error here
-	_, timestamp, _, _ := rtm.Client.SendMessage(c.Channel(), options...)
+	_, timestamp, _, err := slackClient.SendMessage(c.Channel(), options...)
+	if err != nil {
+		slackSendFailures.Inc()
+		log.WithError(err).WithField("channel", c.Channel()).Error("could not send message")
+	}
 	return timestamp
 }
 
@@ -118,6 +150,19 @@ func messageOptions(b *MessageBuilder) []slack.MsgOption {
 				attachment.Footer = b.footer.text
 				attachment.Ts = json.Number(strconv.FormatInt(b.footer.time.Unix(), 10))
 			}
+			if len(b.buttons) > 0 {
+				attachment.CallbackID = b.callbackID
+				attachment.Fallback = text
+				for _, button := range b.buttons {
+					attachment.Actions = append(attachment.Actions, slack.AttachmentAction{
+						Name:  button.name,
+						Text:  button.text,
+						Style: button.style,
+						Type:  "button",
+						Value: button.name,
+					})
+				}
+			}
 			options = append(options, slack.MsgOptionAttachments(attachment))
 		} else {
 			options = append(options, slack.MsgOptionText(text, false))
@@ -126,6 +171,11 @@ func messageOptions(b *MessageBuilder) []slack.MsgOption {
 
 	if b.timestamp != "" {
 		options = append(options, slack.MsgOptionUpdate(b.timestamp))
+	} else if ts := b.conversation.ThreadTimestamp(); b.inThread && ts != "" {
+		options = append(options, slack.MsgOptionTS(ts))
+		if b.broadcast {
+			options = append(options, slack.MsgOptionBroadcast())
+		}
 	}
 
 	return options
@@ -138,3 +188,170 @@ func (c *slackConversation) SetProperties(props *proper.Properties) {
 func (c *slackConversation) String(key string) string {
 	return c.StringParam(key, "")
 }
+
+// channelConversation is a conversation the bot starts on its own, rather than in
+// response to a message, such as a reminder sent to a user.
+type channelConversation struct {
+	user    string
+	channel string
+	thread  string
+	command string
+	*proper.Properties
+}
+
+// NewDirectConversation opens a direct message channel with a user, so the bot can
+// send them messages outside of a conversation they started.
+func NewDirectConversation(user string) (Conversation, error) {
+	_, _, channel, err := slackClient.OpenIMChannel(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &channelConversation{
+		user:       user,
+		channel:    channel,
+		Properties: proper.NewProperties(map[string]string{}),
+	}, nil
+}
+
+// NewThreadConversation continues a conversation in a channel, like one that was started
+// before the bot restarted. Replies in a thread go under the message with the thread
+// timestamp, if there is one.
+func NewThreadConversation(user, channel, thread string) Conversation {
+	return &channelConversation{
+		user:       user,
+		channel:    channel,
+		thread:     thread,
+		Properties: proper.NewProperties(map[string]string{}),
+	}
+}
+
+// NewScheduledConversation runs a command in a channel on behalf of the user who scheduled
+// it, as if they had sent it there.
+func NewScheduledConversation(user, channel, command string) Conversation {
+	return &channelConversation{
+		user:       user,
+		channel:    channel,
+		command:    command,
+		Properties: proper.NewProperties(map[string]string{}),
+	}
+}
+
+// User returns the ID of the user the bot is talking to.
+func (c *channelConversation) User() string {
+	return c.user
+}
+
+// Channel returns the ID of the channel the bot is talking in.
+func (c *channelConversation) Channel() string {
+	return c.channel
+}
+
+// CommandText returns the command the bot is running for a scheduled conversation. For
+// other conversations, it returns an empty string, since the user didn't send a command.
+func (c *channelConversation) CommandText() string {
+	return c.command
+}
+
+// IsDirectMessage returns true if the bot is talking in a direct message channel.
+func (c *channelConversation) IsDirectMessage() bool {
+	return strings.HasPrefix(c.channel, "D")
+}
+
+// ThreadTimestamp returns the timestamp of the message the conversation is threaded under,
+// or an empty string if there is no message to reply to.
+func (c *channelConversation) ThreadTimestamp() string {
+	return c.thread
+}
+
+func (c *channelConversation) Send(b *MessageBuilder) string {
+	return sendMessage(c, b)
+}
+
+func (c *channelConversation) SetProperties(props *proper.Properties) {
+	c.Properties = props
+}
+
+func (c *channelConversation) String(key string) string {
+	return c.StringParam(key, "")
+}
+
+// eventConversation is a conversation started by a request to the bot's HTTP server, either
+// an Events API callback or a slash command.
+type eventConversation struct {
+	user    string
+	channel string
+	text    string
+	thread  string
+	*proper.Properties
+}
+
+// NewEventConversation creates a conversation from a message that was sent to the bot through
+// the Events API, like an @mention or a direct message. Replies in a thread go under the
+// message with the thread timestamp, if there is one.
+func NewEventConversation(user, channel, text, thread string) Conversation {
+	return &eventConversation{
+		user:       user,
+		channel:    channel,
+		text:       text,
+		thread:     thread,
+		Properties: proper.NewProperties(map[string]string{}),
+	}
+}
+
+// NewSlashCommandConversation creates a conversation from a slash command like
+// `/macbot check out host`. A slash command with no text asks for help.
+func NewSlashCommandConversation(cmd slack.SlashCommand) Conversation {
+	text := cmd.Text
+	if strings.TrimSpace(text) == "" {
+		text = "help"
+	}
+
+	// Slash commands don't create a message, so there's nothing to reply to in a thread
+	return NewEventConversation(cmd.UserID, cmd.ChannelID, text, "")
+}
+
+// User returns the ID of the user who initiated the conversation.
+func (c *eventConversation) User() string {
+	return c.user
+}
+
+// Channel returns the ID of the channel where the conversation is happening.
+func (c *eventConversation) Channel() string {
+	return c.channel
+}
+
+// CommandText extracts the command out of the message text.
+//
+// Slack only sends the bot events for messages directed to it, so unlike messages from
+// the RTM API, these don't need to be filtered.
+func (c *eventConversation) CommandText() string {
+	// Ignore messages that the bot sent, no matter what
+	if c.user == botUserID {
+		return ""
+	}
+
+	return commandText(c.text)
+}
+
+// IsDirectMessage returns true if the conversation was started via direct message.
+func (c *eventConversation) IsDirectMessage() bool {
+	return strings.HasPrefix(c.channel, "D")
+}
+
+// ThreadTimestamp returns the timestamp of the user's message, or of the thread it is in.
+func (c *eventConversation) ThreadTimestamp() string {
+	return c.thread
+}
+
+func (c *eventConversation) Send(b *MessageBuilder) string {
+	return sendMessage(c, b)
+}
+
+func (c *eventConversation) SetProperties(props *proper.Properties) {
+	c.Properties = props
+}
+
+func (c *eventConversation) String(key string) string {
+	return c.StringParam(key, "")
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
 	"strconv"
 	"strings"
+	"testing"
 )
 
 type testConversation struct {
@@ -22,6 +24,8 @@ func newTestConversation(command string) *testConversation {
 		user:    "user",
 		command: command,
 		replies: nil,
+
+		Properties: proper.NewProperties(map[string]string{}),
 	}
 }
 
@@ -41,6 +45,10 @@ func (c *testConversation) IsDirectMessage() bool {
 	return strings.HasPrefix(c.channel, "D")
 }
 
+func (c *testConversation) ThreadTimestamp() string {
+	return "100.001"
+}
+
 func (c *testConversation) Send(b *MessageBuilder) string {
 	c.timestamp++
 	timestamp := strconv.Itoa(c.timestamp)
@@ -55,3 +63,13 @@ func (c *testConversation) SetProperties(props *proper.Properties) {
 func (c *testConversation) String(key string) string {
 	return c.StringParam(key, "")
 }
+
+func TestEventConversationCommandText(t *testing.T) {
+	botUserID = "UBOT"
+
+	conv := NewEventConversation("U1", "C1", "<@UBOT>   Build Image high-sierra ", "")
+	require.Equal(t, "build image high-sierra", conv.CommandText())
+
+	conv = NewEventConversation("UBOT", "C1", "check out host", "")
+	require.Equal(t, "", conv.CommandText())
+}
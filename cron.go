@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minScheduleInterval is the shortest time allowed between runs of a scheduled command.
+const minScheduleInterval = time.Minute
+
+// ScheduleSpec decides when a scheduled command runs next.
+type ScheduleSpec interface {
+	// Next returns the first time the command should run after t.
+	Next(t time.Time) time.Time
+}
+
+// ParseScheduleSpec parses how often a command should run. It can either be a duration, like
+// `24h`, or a cron expression with five fields, like `0 9 * * mon`.
+func ParseScheduleSpec(s string) (ScheduleSpec, error) {
+	s = strings.TrimSpace(s)
+	if fields := strings.Fields(s); len(fields) == 5 {
+		return parseCron(fields)
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("`%s` isn't a duration like `24h` or a cron expression like `0 9 * * mon`", s)
+	}
+	if d < minScheduleInterval {
+		return nil, fmt.Errorf("commands can't run more often than every %s", minScheduleInterval)
+	}
+
+	return intervalSpec(d), nil
+}
+
+// intervalSpec runs a command at a fixed interval.
+type intervalSpec time.Duration
+
+func (s intervalSpec) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSpec runs a command at the times matched by a cron expression. Each field is a set of
+// bits, one for each value that matches.
+type cronSpec struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// Like cron, if both days and weekdays are restricted, a time matches if either does.
+	// A field is only unrestricted if it's exactly `*`, so `*/2` still restricts the days.
+	anyDay     bool
+	anyWeekday bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 6, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+func parseCron(fields []string) (ScheduleSpec, error) {
+	var bits [5]uint64
+	for i, f := range cronFields {
+		b, err := f.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+
+	spec := &cronSpec{
+		minutes:    bits[0],
+		hours:      bits[1],
+		days:       bits[2],
+		months:     bits[3],
+		weekdays:   bits[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	if spec.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("`%s` never matches any time", strings.Join(fields, " "))
+	}
+
+	return spec, nil
+}
+
+// parse turns a field like `*/15`, `1-5` or `mon,wed,fri` into the set of values it matches.
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("`%s` isn't a valid step for the %s", part[i+1:], f.name)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("`%s` is backwards for the %s", part, f.name)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if s == name {
+			return f.min + i, nil
+		}
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("`%s` isn't a valid %s", s, f.name)
+	}
+	return n, nil
+}
+
+// cronSearchLimit stops Next from looking forever for a time that can never match, like
+// the 31st of February.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+func (s *cronSpec) Next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (s *cronSpec) dayMatches(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleSpecInterval(t *testing.T) {
+	spec, err := ParseScheduleSpec("24h")
+	require.NoError(t, err)
+
+	now := time.Date(2018, 11, 5, 10, 30, 0, 0, time.UTC)
+	require.Equal(t, now.Add(24*time.Hour), spec.Next(now))
+}
+
+func TestParseScheduleSpecCron(t *testing.T) {
+	tests := []struct {
+		spec string
+		from time.Time
+		next time.Time
+	}{
+		// Monday the 5th of November 2018, at 10:30.
+		{"0 9 * * mon", time.Date(2018, 11, 5, 10, 30, 0, 0, time.UTC), time.Date(2018, 11, 12, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, 11, 5, 10, 30, 0, 0, time.UTC), time.Date(2018, 11, 5, 10, 45, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2018, 12, 31, 23, 59, 30, 0, time.UTC), time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 8-17 * * 1-5", time.Date(2018, 11, 9, 18, 0, 0, 0, time.UTC), time.Date(2018, 11, 12, 8, 30, 0, 0, time.UTC)},
+		{"0 12 29 feb *", time.Date(2018, 11, 5, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC)},
+		// Only odd days, not every day.
+		{"0 9 */2 * *", time.Date(2018, 11, 1, 10, 30, 0, 0, time.UTC), time.Date(2018, 11, 3, 9, 0, 0, 0, time.UTC)},
+		// Either the 1st of the month or a Friday, like cron.
+		{"0 0 1 * fri", time.Date(2018, 11, 5, 0, 0, 0, 0, time.UTC), time.Date(2018, 11, 9, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		spec, err := ParseScheduleSpec(tt.spec)
+		require.NoError(t, err, tt.spec)
+		require.Equal(t, tt.next, spec.Next(tt.from), tt.spec)
+	}
+}
+
+func TestParseScheduleSpecErrors(t *testing.T) {
+	tests := map[string]string{
+		"soon":           "`soon` isn't a duration like `24h` or a cron expression like `0 9 * * mon`",
+		"30s":            "commands can't run more often than every 1m0s",
+		"60 * * * *":     "`60` isn't a valid minute",
+		"0 9 * * sunday": "`sunday` isn't a valid day of week",
+		"0 17-9 * * *":   "`17-9` is backwards for the hour",
+		"*/0 * * * *":    "`0` isn't a valid step for the minute",
+		"0 0 31 feb *":   "`0 0 31 feb *` never matches any time",
+	}
+
+	for spec, msg := range tests {
+		_, err := ParseScheduleSpec(spec)
+		require.EqualError(t, err, msg, spec)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FakeJobBoard is an in-memory job board that serves the parts of the job board API the bot
+// uses: listing, registering, updating and deleting images at /images. It can be used with
+// httptest in tests, and stands in for the real job boards in debug mode.
+//
+// Requests must use basic auth with the fake's password. Registering an image that already
+// exists in the same infra replaces its tags, and images are listed in the order they were
+// last registered or updated.
+type FakeJobBoard struct {
+	Password string
+
+	mu     sync.Mutex
+	nextID int64
+	images []imagePayload
+}
+
+// NewFakeJobBoard creates a fake job board with no images that accepts the given password.
+func NewFakeJobBoard(password string) *FakeJobBoard {
+	return &FakeJobBoard{Password: password}
+}
+
+// startFakeJobBoard serves a fake job board on a random local port, returning its URL.
+func startFakeJobBoard(fake *FakeJobBoard) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go http.Serve(l, fake)
+	return "http://" + l.Addr().String(), nil
+}
+
+func (f *FakeJobBoard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, password, ok := r.BasicAuth(); !ok || password != f.Password {
+		writeFakeJobBoardError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	if r.URL.Path != "/images" {
+		writeFakeJobBoardError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f.listImages(w, r)
+	case "POST":
+		f.registerImage(w, r)
+	case "PUT":
+		f.updateImage(w, r)
+	case "DELETE":
+		f.deleteImage(w, r)
+	default:
+		writeFakeJobBoardError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (f *FakeJobBoard) listImages(w http.ResponseWriter, r *http.Request) {
+	infra := r.FormValue("infra")
+	name := r.FormValue("name")
+
+	f.mu.Lock()
+	images := []imagePayload{}
+	for _, i := range f.images {
+		if (infra == "" || i.Infra == infra) && (name == "" || i.Name == name) {
+			images = append(images, i)
+		}
+	}
+	f.mu.Unlock()
+
+	writeFakeJobBoardJSON(w, http.StatusOK, imageListPayload{Data: images})
+}
+
+func (f *FakeJobBoard) registerImage(w http.ResponseWriter, r *http.Request) {
+	infra := r.FormValue("infra")
+	name := r.FormValue("name")
+	if infra == "" || name == "" {
+		writeFakeJobBoardError(w, http.StatusBadRequest, "infra and name are required")
+		return
+	}
+
+	tags, ok := parseJobBoardTags(r.FormValue("tags"))
+	if !ok {
+		writeFakeJobBoardError(w, http.StatusBadRequest, "tags must look like key:value,key:value")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	image := imagePayload{
+		Infra:     infra,
+		Name:      name,
+		Tags:      tags,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	status := http.StatusCreated
+
+	if i := f.find(infra, name); i >= 0 {
+		image.ID = f.images[i].ID
+		image.CreatedAt = f.images[i].CreatedAt
+		f.images = append(f.images[:i], f.images[i+1:]...)
+		status = http.StatusOK
+	} else {
+		f.nextID++
+		image.ID = f.nextID
+	}
+	f.images = append(f.images, image)
+
+	writeFakeJobBoardJSON(w, status, imageListPayload{Data: []imagePayload{image}})
+}
+
+func (f *FakeJobBoard) updateImage(w http.ResponseWriter, r *http.Request) {
+	tags, ok := parseJobBoardTags(r.FormValue("tags"))
+	if !ok {
+		writeFakeJobBoardError(w, http.StatusBadRequest, "tags must look like key:value,key:value")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := f.find(r.FormValue("infra"), r.FormValue("name"))
+	if i < 0 {
+		writeFakeJobBoardError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	image := f.images[i]
+	image.Tags = tags
+	image.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	f.images = append(append(f.images[:i], f.images[i+1:]...), image)
+
+	writeFakeJobBoardJSON(w, http.StatusOK, imageListPayload{Data: []imagePayload{image}})
+}
+
+func (f *FakeJobBoard) deleteImage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := f.find(r.FormValue("infra"), r.FormValue("name"))
+	if i < 0 {
+		writeFakeJobBoardError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	f.images = append(f.images[:i], f.images[i+1:]...)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// find returns the index of an image, or -1 if there isn't one. The caller must hold the lock.
+func (f *FakeJobBoard) find(infra, name string) int {
+	for i, image := range f.images {
+		if image.Infra == infra && image.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func writeFakeJobBoardJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeJobBoardError(w http.ResponseWriter, status int, message string) {
+	writeFakeJobBoardJSON(w, status, map[string]string{"error": message})
+}
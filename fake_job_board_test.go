@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestFakeJobBoard() (*JobBoard, func()) {
+	srv := httptest.NewServer(NewFakeJobBoard("secret"))
+	return NewJobBoard(srv.URL, "secret"), srv.Close
+}
+
+func TestFakeJobBoard(t *testing.T) {
+	jb, done := newTestFakeJobBoard()
+	defer done()
+	ctx := context.TODO()
+
+	images, err := jb.ListImages(ctx)
+	require.NoError(t, err)
+	require.Empty(t, images)
+
+	require.NoError(t, jb.RegisterImage(ctx, "xcode9-1000", "xcode9"))
+	require.NoError(t, jb.RegisterImage(ctx, "xcode10-1000", "xcode10"))
+	require.NoError(t, jb.RegisterImage(ctx, "xcode10-2000", "xcode10"))
+
+	images, err = jb.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+	for i, name := range []string{"xcode9-1000", "xcode10-1000", "xcode10-2000"} {
+		require.Equal(t, int64(i+1), images[i].ID)
+		require.Equal(t, name, images[i].Name)
+		require.Equal(t, "jupiterbrain", images[i].Infra)
+		require.False(t, images[i].CreatedAt.IsZero())
+	}
+	require.Equal(t, map[string]string{"os": "osx", "osx_image": "xcode9"}, images[0].Tags)
+	require.Equal(t, "xcode9", images[0].Tag)
+
+	// Registering an existing image again moves its tag back to it
+	require.NoError(t, jb.RegisterImage(ctx, "xcode10-1000", "xcode10"))
+	images, err = jb.ListImages(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "xcode10-1000", taggedImage(images, "xcode10"))
+
+	require.NoError(t, jb.DeleteImage(ctx, "xcode9-1000"))
+	err = jb.DeleteImage(ctx, "xcode9-1000")
+	require.EqualError(t, err, "job board responded with 404 Not Found: image not found")
+
+	images, err = jb.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+}
+
+func TestJobBoardOnInfra(t *testing.T) {
+	jb, done := newTestFakeJobBoard()
+	defer done()
+	ctx := context.TODO()
+
+	gce := jb.OnInfra("gce")
+	require.Equal(t, "jupiterbrain", jb.Infra)
+	require.NoError(t, gce.RegisterImage(ctx, "xcode10-1000", "xcode10"))
+
+	images, err := jb.ListImages(ctx)
+	require.NoError(t, err)
+	require.Empty(t, images)
+
+	images, err = gce.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, "gce", images[0].Infra)
+
+	require.NoError(t, gce.SetTags(ctx, "xcode10-1000", map[string]string{"osx_image": "xcode10", "xcode": "10.1"}))
+	images, err = gce.ListImages(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"osx_image": "xcode10", "xcode": "10.1"}, images[0].Tags)
+
+	err = jb.SetTags(ctx, "xcode10-1000", nil)
+	require.Error(t, err)
+	require.Equal(t, JobBoardNotFound, err.(*JobBoardError).Kind)
+}
+
+func TestFakeJobBoardChecksPassword(t *testing.T) {
+	srv := httptest.NewServer(NewFakeJobBoard("secret"))
+	defer srv.Close()
+
+	_, err := NewJobBoard(srv.URL, "wrong").ListImages(context.TODO())
+	require.Error(t, err)
+	require.Equal(t, JobBoardAuthFailed, err.(*JobBoardError).Kind)
+}
+
+func TestParseJobBoardTags(t *testing.T) {
+	tags, ok := parseJobBoardTags("os:osx,osx_image:xcode10")
+	require.True(t, ok)
+	require.Equal(t, map[string]string{"os": "osx", "osx_image": "xcode10"}, tags)
+
+	_, ok = parseJobBoardTags("osx")
+	require.False(t, ok)
+}
+
+func TestJobBoardCommandsWithFakeJobBoard(t *testing.T) {
+	jb, done := newTestFakeJobBoard()
+	defer done()
+	jobBoards = map[string]*JobBoard{"staging": jb}
+	defer func() { jobBoards = nil }()
+	setupBaseImages("xcode10-1000")
+
+	conv := newTestConversation("register image xcode10-1000 as xcode10 in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "xcode10-1000",
+		"tag":   "xcode10",
+		"env":   "staging",
+	}))
+	RegisterImage(context.TODO(), conv)
+	require.Equal(t, "Successfully registered image for <@user>", conv.replies[0].text)
+
+	conv = newTestConversation("registered images in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{"env": "staging"}))
+	ListImages(context.TODO(), conv)
+	require.Equal(t, "<@user>: macOS images registered in job-board-staging on jupiterbrain:\n\n• `xcode10-1000`: `os:osx`, `osx_image:xcode10`. Registered now.", conv.replies[0].text)
+
+	conv = newTestConversation("set tag xcode=10.1 on image xcode10-1000 in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"tag":   "xcode=10.1",
+		"image": "xcode10-1000",
+		"env":   "staging",
+	}))
+	SetImageTag(context.TODO(), conv)
+	require.Equal(t, "Successfully changed the tags of an image for <@user>", conv.replies[0].text)
+
+	conv = newTestConversation("registered images in staging on gce")
+	conv.SetProperties(proper.NewProperties(map[string]string{"env": "staging", "infra": "gce"}))
+	ListImages(context.TODO(), conv)
+	require.Equal(t, "<@user>: macOS images registered in job-board-staging on gce:\n", conv.replies[0].text)
+
+	conv = newTestConversation("registered images in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{"env": "staging"}))
+	ListImages(context.TODO(), conv)
+	require.Contains(t, conv.replies[0].text, "• `xcode10-1000`: `os:osx`, `osx_image:xcode10`, `xcode:10.1`.")
+
+	conv = newTestConversation("unregister image xcode10-1000 in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "xcode10-1000",
+		"env":   "staging",
+	}))
+	confirmations = NewConfirmations(time.Hour)
+	UnregisterImage(context.TODO(), conv)
+	clickButton(conv, "user", "confirm")
+	require.Equal(t, "Successfully unregistered image for <@user>", conv.replies[len(conv.replies)-1].text)
+
+	images, err := jb.ListImages(context.TODO())
+	require.NoError(t, err)
+	require.Empty(t, images)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var slackHealth = NewConnectionHealth(time.Hour)
+
+// ConnectionHealth keeps track of whether the bot's connection to Slack is working, so that
+// /healthz can report it.
+type ConnectionHealth struct {
+	// MaxQuiet is how long the connection can go without any events before it's considered
+	// dead. If it is zero, a quiet connection is still healthy. It has to be set before the
+	// health is checked for the first time.
+	MaxQuiet time.Duration
+
+	mu        sync.Mutex
+	connected bool
+	reason    string
+	lastEvent time.Time
+	now       func() time.Time
+}
+
+// NewConnectionHealth creates a connection that hasn't connected yet.
+func NewConnectionHealth(maxQuiet time.Duration) *ConnectionHealth {
+	return &ConnectionHealth{
+		MaxQuiet: maxQuiet,
+		reason:   "not connected to Slack yet",
+		now:      time.Now,
+	}
+}
+
+// Connected records that the connection is up.
+func (h *ConnectionHealth) Connected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.connected = true
+	h.reason = ""
+	h.lastEvent = h.now()
+	slackConnected.Set(1)
+}
+
+// Disconnected records that the connection is down, and why.
+func (h *ConnectionHealth) Disconnected(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.connected = false
+	h.reason = reason
+	slackConnected.Set(0)
+}
+
+// Event records that something arrived over the connection, showing it's still alive.
+func (h *ConnectionHealth) Event() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastEvent = h.now()
+}
+
+// Latency records how long Slack took to answer the last ping.
+func (h *ConnectionHealth) Latency(d time.Duration) {
+	slackLatency.Set(d.Seconds())
+}
+
+// Check returns an error saying what's wrong if the connection isn't healthy.
+func (h *ConnectionHealth) Check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.connected {
+		return errors.New(h.reason)
+	}
+
+	if quiet := h.now().Sub(h.lastEvent); h.MaxQuiet > 0 && quiet > h.MaxQuiet {
+		return fmt.Errorf("no events from Slack in %s", quiet.Round(time.Second))
+	}
+
+	return nil
+}
+
+// HealthHandler responds with 200 OK if the connection is healthy, or 503 Service Unavailable
+// with the reason if it isn't.
+func HealthHandler(h *ConnectionHealth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if err := h.Check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectionHealth(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	h := NewConnectionHealth(time.Hour)
+	h.now = func() time.Time { return now }
+
+	require.EqualError(t, h.Check(), "not connected to Slack yet")
+
+	h.Connected()
+	require.NoError(t, h.Check())
+
+	now = now.Add(90 * time.Minute)
+	require.EqualError(t, h.Check(), "no events from Slack in 1h30m0s")
+
+	h.Event()
+	require.NoError(t, h.Check())
+
+	h.Disconnected("disconnected from Slack")
+	require.EqualError(t, h.Check(), "disconnected from Slack")
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := NewConnectionHealth(0)
+
+	w := httptest.NewRecorder()
+	HealthHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, 503, w.Code)
+	require.Equal(t, "not connected to Slack yet\n", w.Body.String())
+
+	h.Connected()
+
+	w = httptest.NewRecorder()
+	HealthHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "ok\n", w.Body.String())
+}
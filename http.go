@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slackevents"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxRequestAge is how old a signed request from Slack can be before we reject it, to
+// protect against replay attacks.
+const maxRequestAge = 5 * time.Minute
+
+// verifySlackRequest checks that a request body was signed by Slack with our signing secret.
+//
+// See https://api.slack.com/docs/verifying-requests-from-slack
+func verifySlackRequest(h http.Header, body []byte, secret string, now time.Time) error {
+	timestamp := h.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid request timestamp")
+	}
+
+	if math.Abs(now.Sub(time.Unix(ts, 0)).Seconds()) > maxRequestAge.Seconds() {
+		return errors.New("request timestamp is too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(h.Get("X-Slack-Signature"))) {
+		return errors.New("request signature does not match")
+	}
+
+	return nil
+}
+
+// readSlackRequest reads the body of a request from Slack, verifying its signature.
+// If the signing secret is empty, the signature is not checked.
+func readSlackRequest(w http.ResponseWriter, r *http.Request, secret string) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		return body, nil
+	}
+
+	if err := verifySlackRequest(r.Header, body, secret, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// ActionHandler returns an HTTP handler that receives Slack's interactive message payloads
+// and sends each button click to the router.
+//
+// Actions are handled in the background, since Slack expects a response within a few seconds.
+// Handlers update the original message themselves.
+func ActionHandler(router *Router, signingSecret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := readSlackRequest(w, r, signingSecret)
+		if err != nil {
+			log.WithError(err).Warn("rejecting action request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var callback slack.AttachmentActionCallback
+		if err := json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+			log.WithError(err).Warn("could not parse action payload")
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		for _, action := range callback.Actions {
+			go router.Act(context.Background(), Action{
+				CallbackID:       callback.CallbackID,
+				Name:             action.Name,
+				User:             callback.User.ID,
+				Channel:          callback.Channel.ID,
+				MessageTimestamp: callback.MessageTs,
+			})
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// eventCallback is the outer part of a request from the Events API. The challenge is only
+// set for URL verification requests, and the event is only set for event callbacks.
+type eventCallback struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// EventHandler returns an HTTP handler that receives Events API callbacks and sends the
+// messages directed to the bot to the router.
+//
+// The bot should be subscribed to the app_mention and message.im events. Other events are
+// ignored.
+func EventHandler(router *Router, signingSecret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := readSlackRequest(w, r, signingSecret)
+		if err != nil {
+			log.WithError(err).Warn("rejecting event request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// We acknowledge events right away, so a retry means Slack didn't hear back from
+		// us in time. Handling it again would run the command twice.
+		if retry := r.Header.Get("X-Slack-Retry-Num"); retry != "" {
+			log.WithField("retry", retry).Info("ignoring retried event")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		var callback eventCallback
+		if err := json.Unmarshal(body, &callback); err != nil {
+			log.WithError(err).Warn("could not parse event request")
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		switch callback.Type {
+		case slackevents.URLVerification:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(callback.Challenge))
+			return
+		case slackevents.CallbackEvent:
+			if conv := eventConversationFor(callback.Event); conv != nil {
+				go router.Reply(context.Background(), conv)
+			}
+		default:
+			log.WithField("type", callback.Type).Debug("ignoring event request")
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// eventConversationFor creates a conversation for an event if it is a message to the bot.
+func eventConversationFor(raw json.RawMessage) Conversation {
+	var ev slackevents.MessageEvent
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		log.WithError(err).Warn("could not parse event")
+		return nil
+	}
+
+	// Messages from bots, and edits or deletions of messages, aren't commands
+	if ev.BotID != "" || ev.SubType != "" {
+		return nil
+	}
+
+	switch {
+	case ev.Type == "app_mention":
+	case ev.Type == "message" && ev.ChannelType == "im":
+	default:
+		log.WithField("type", ev.Type).Debug("ignoring event")
+		return nil
+	}
+
+	thread := ev.ThreadTimeStamp
+	if thread == "" {
+		thread = ev.TimeStamp
+	}
+
+	return NewEventConversation(ev.User, ev.Channel, ev.Text, thread)
+}
+
+// SlashCommandHandler returns an HTTP handler that receives slash commands like
+// `/macbot check out host` and sends them to the router.
+//
+// The bot replies in the channel the command was used in, so it needs to be a member of
+// that channel.
+func SlashCommandHandler(router *Router, signingSecret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := readSlackRequest(w, r, signingSecret)
+		if err != nil {
+			log.WithError(err).Warn("rejecting slash command request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		cmd, err := slack.SlashCommandParse(r)
+		if err != nil {
+			log.WithError(err).Warn("could not parse slash command")
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		go router.Reply(context.Background(), NewSlashCommandConversation(cmd))
+
+		// Responding in the channel makes Slack show everyone the command that was used,
+		// so the bot's replies make sense.
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response_type":"in_channel"}`))
+	})
+}
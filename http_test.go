@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedHeader(body string, secret string, ts time.Time) http.Header {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+
+	h := http.Header{}
+	h.Set("X-Slack-Request-Timestamp", timestamp)
+	h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return h
+}
+
+func TestVerifySlackRequest(t *testing.T) {
+	now := time.Now()
+	body := "payload=%7B%7D"
+
+	h := signedHeader(body, "secret", now)
+	require.NoError(t, verifySlackRequest(h, []byte(body), "secret", now))
+	require.Error(t, verifySlackRequest(h, []byte(body), "other-secret", now))
+	require.Error(t, verifySlackRequest(h, []byte("payload=tampered"), "secret", now))
+
+	old := signedHeader(body, "secret", now.Add(-10*time.Minute))
+	require.Error(t, verifySlackRequest(old, []byte(body), "secret", now))
+
+	require.Error(t, verifySlackRequest(http.Header{}, []byte(body), "secret", now))
+}
+
+// commandRecorder returns a router that sends the user and command text of every
+// conversation it handles to the channel.
+func commandRecorder() (*Router, chan string) {
+	commands := make(chan string, 1)
+	router := NewRouter()
+	router.HandleFunc("check out host", func(_ context.Context, conv Conversation) {
+		commands <- conv.User() + " " + conv.CommandText()
+	})
+	router.HandleFunc("help", func(_ context.Context, conv Conversation) {
+		commands <- conv.User() + " " + conv.CommandText()
+	})
+	return router, commands
+}
+
+func postSigned(h http.Handler, body string, contentType string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header = signedHeader(body, "secret", time.Now())
+	req.Header.Set("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestEventHandlerURLVerification(t *testing.T) {
+	router, _ := commandRecorder()
+	w := postSigned(EventHandler(router, "secret"), `{"type":"url_verification","challenge":"abc123"}`, "application/json")
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "abc123", w.Body.String())
+}
+
+func TestEventHandlerAppMention(t *testing.T) {
+	botUserID = "UBOT"
+	router, commands := commandRecorder()
+	body := `{"type":"event_callback","event":{"type":"app_mention","user":"U1","channel":"C1","text":"<@UBOT> Check out host"}}`
+	w := postSigned(EventHandler(router, "secret"), body, "application/json")
+
+	require.Equal(t, http.StatusOK, w.Code)
+	select {
+	case cmd := <-commands:
+		require.Equal(t, "U1 check out host", cmd)
+	case <-time.After(time.Second):
+		t.Fatal("event was not sent to the router")
+	}
+}
+
+func TestEventHandlerRejectsUnsignedRequests(t *testing.T) {
+	router, _ := commandRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"type":"url_verification","challenge":"abc123"}`))
+	w := httptest.NewRecorder()
+	EventHandler(router, "secret").ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestSlashCommandHandler(t *testing.T) {
+	router, commands := commandRecorder()
+	w := postSigned(SlashCommandHandler(router, "secret"), "command=%2Fmacbot&text=&user_id=U1&channel_id=C1", "application/x-www-form-urlencoded")
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "in_channel")
+	select {
+	case cmd := <-commands:
+		require.Equal(t, "U1 help", cmd)
+	case <-time.After(time.Second):
+		t.Fatal("slash command was not sent to the router")
+	}
+}
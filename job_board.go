@@ -3,18 +3,40 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 )
 
+// jobBoardRetries is how many times a request that can safely be repeated is retried if it
+// fails in a way that might not happen again, like job board returning a server error.
+const jobBoardRetries = 3
+
+// jobBoardRetryDelay is how long to wait before the first retry. The wait doubles for each
+// retry after that.
+var jobBoardRetryDelay = time.Second
+
+// maxJobBoardResponse is the most of a response body that is read, so that a misbehaving
+// server can't use up all our memory.
+const maxJobBoardResponse = 10 << 20
+
+// defaultJobBoardInfra is the infrastructure whose images are managed if the config doesn't
+// name one.
+const defaultJobBoardInfra = "jupiterbrain"
+
 // JobBoard is a client for interacting with an instance of job-board.
+//
+// The client manages the images for one infrastructure. Use OnInfra to manage another.
 type JobBoard struct {
 	Host     string
 	Password string
+	Infra    string
 	client   *http.Client
 }
 
@@ -27,15 +49,30 @@ func NewJobBoard(host, password string) *JobBoard {
 	return &JobBoard{
 		Host:     host,
 		Password: password,
+		Infra:    defaultJobBoardInfra,
 		client:   client,
 	}
 }
 
+// OnInfra returns a client for the same job board that manages the images for another
+// infrastructure.
+func (jb *JobBoard) OnInfra(infra string) *JobBoard {
+	c := *jb
+	c.Infra = infra
+	return &c
+}
+
 // JobBoardImage is a registered macOS-based image in job board.
 type JobBoardImage struct {
-	ID   int64
-	Tag  string
-	Name string
+	ID    int64
+	Infra string
+	Name  string
+	// Tag is the image's osx_image tag, which is how builds choose it.
+	Tag       string
+	Tags      map[string]string
+	IsDefault bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 type imageListPayload struct {
@@ -43,28 +80,97 @@ type imageListPayload struct {
 }
 
 type imagePayload struct {
-	ID        int64
-	Infra     string
-	Name      string
-	Tags      map[string]string
-	IsDefault bool   `json:"is_default"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID        int64             `json:"id"`
+	Infra     string            `json:"infra"`
+	Name      string            `json:"name"`
+	Tags      map[string]string `json:"tags"`
+	IsDefault bool              `json:"is_default"`
+	CreatedAt string            `json:"created_at"`
+	UpdatedAt string            `json:"updated_at"`
 }
 
-// ListImages lists images by their osx_image tag.
-func (jb *JobBoard) ListImages(ctx context.Context) ([]JobBoardImage, error) {
-	req, err := jb.newRequest("GET", "/images?infra=jupiterbrain", nil)
-	if err != nil {
-		return nil, err
+// JobBoardErrorKind says what went wrong with a request job board didn't accept.
+type JobBoardErrorKind int
+
+// The kinds of errors job board can respond with.
+const (
+	JobBoardUnexpected JobBoardErrorKind = iota
+	JobBoardAuthFailed
+	JobBoardNotFound
+	JobBoardConflict
+	JobBoardServerError
+)
+
+// JobBoardError is returned when job board responds to a request with an error status.
+type JobBoardError struct {
+	Kind       JobBoardErrorKind
+	StatusCode int
+	// Message is the error job board gave, if it gave one.
+	Message string
+}
+
+func (e *JobBoardError) Error() string {
+	status := fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message == "" {
+		return "job board responded with " + status
 	}
 
-	resp, err := jb.client.Do(req)
-	if err != nil {
-		return nil, err
+	return fmt.Sprintf("job board responded with %s: %s", status, e.Message)
+}
+
+// newJobBoardError works out what kind of error a response is, and what job board said
+// about it.
+func newJobBoardError(status int, body []byte) *JobBoardError {
+	e := &JobBoardError{
+		StatusCode: status,
+		Message:    jobBoardErrorMessage(body),
+	}
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Kind = JobBoardAuthFailed
+	case status == http.StatusNotFound:
+		e.Kind = JobBoardNotFound
+	case status == http.StatusConflict:
+		e.Kind = JobBoardConflict
+	case status >= 500:
+		e.Kind = JobBoardServerError
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	return e
+}
+
+// jobBoardErrorMessage pulls the error message out of a response body. Job board usually
+// sends JSON, but proxies in front of it can send plain text or HTML error pages, which
+// aren't worth showing.
+func jobBoardErrorMessage(body []byte) string {
+	var payload struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if payload.Error != "" {
+			return payload.Error
+		}
+		return payload.Message
+	}
+
+	msg := strings.TrimSpace(string(body))
+	if strings.HasPrefix(msg, "<") {
+		return ""
+	}
+	if len(msg) > 200 {
+		msg = msg[:200] + "…"
+	}
+	return msg
+}
+
+// ListImages lists the images registered for the client's infrastructure.
+func (jb *JobBoard) ListImages(ctx context.Context) ([]JobBoardImage, error) {
+	v := url.Values{}
+	v.Set("infra", jb.Infra)
+
+	body, err := jb.do(ctx, "GET", "/images?"+v.Encode(), nil, "list")
 	if err != nil {
 		return nil, err
 	}
@@ -77,47 +183,174 @@ func (jb *JobBoard) ListImages(ctx context.Context) ([]JobBoardImage, error) {
 	images := make([]JobBoardImage, len(imageList.Data))
 	for i, payload := range imageList.Data {
 		images[i] = JobBoardImage{
-			ID:   payload.ID,
-			Tag:  payload.Tags["osx_image"],
-			Name: payload.Name,
+			ID:        payload.ID,
+			Infra:     payload.Infra,
+			Name:      payload.Name,
+			Tag:       payload.Tags["osx_image"],
+			Tags:      payload.Tags,
+			IsDefault: payload.IsDefault,
+			CreatedAt: parseJobBoardTime(payload.CreatedAt),
+			UpdatedAt: parseJobBoardTime(payload.UpdatedAt),
 		}
 	}
 
 	return images, nil
 }
 
+// parseJobBoardTime parses a timestamp from job board, returning the zero time if it's
+// missing or can't be parsed.
+func parseJobBoardTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
 // RegisterImage adds an image to job board with the given osx_image tag.
+//
+// Registering creates a new image, so it isn't retried if it fails.
 func (jb *JobBoard) RegisterImage(ctx context.Context, image, tag string) error {
 	v := url.Values{}
-	v.Set("infra", "jupiterbrain")
+	v.Set("infra", jb.Infra)
 	v.Set("name", image)
-	v.Set("tags", "os:osx,osx_image:"+tag)
+	v.Set("tags", formatJobBoardTags(map[string]string{"os": "osx", "osx_image": tag}))
 
-	body := strings.NewReader(v.Encode())
-	req, err := jb.newRequest("POST", "/images", body)
-	if err != nil {
-		return err
-	}
+	_, err := jb.do(ctx, "POST", "/images", v, "register")
+	return err
+}
+
+// SetTags replaces all of the tags on an image in job board.
+func (jb *JobBoard) SetTags(ctx context.Context, image string, tags map[string]string) error {
+	v := url.Values{}
+	v.Set("infra", jb.Infra)
+	v.Set("name", image)
+	v.Set("tags", formatJobBoardTags(tags))
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	_, err = jb.client.Do(req)
+	_, err := jb.do(ctx, "PUT", "/images", v, "update")
 	return err
 }
 
+// formatJobBoardTags writes tags in the form job board takes them, like
+// `os:osx,osx_image:xcode10`, sorted by key.
+func formatJobBoardTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+":"+v)
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// parseJobBoardTags parses tags in the form job board takes them, like
+// `os:osx,osx_image:xcode10`.
+func parseJobBoardTags(s string) (map[string]string, bool) {
+	tags := make(map[string]string)
+	if s == "" {
+		return tags, true
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, false
+		}
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, true
+}
+
 // DeleteImage removes an image from job board.
 func (jb *JobBoard) DeleteImage(ctx context.Context, image string) error {
 	v := url.Values{}
-	v.Set("infra", "jupiterbrain")
+	v.Set("infra", jb.Infra)
 	v.Set("name", image)
 
-	u := "/images?" + v.Encode()
-	req, err := jb.newRequest("DELETE", u, nil)
+	_, err := jb.do(ctx, "DELETE", "/images?"+v.Encode(), nil, "delete")
+	return err
+}
+
+// do sends a request to job board and returns the body of its response. If form isn't nil,
+// it is sent as the body of the request.
+//
+// Requests other than POSTs can safely be repeated, so they are retried with backoff if
+// they fail in a way that might not happen again.
+func (jb *JobBoard) do(ctx context.Context, method, path string, form url.Values, operation string) ([]byte, error) {
+	delay := jobBoardRetryDelay
+	for attempt := 0; ; attempt++ {
+		body, err := jb.send(ctx, method, path, form, operation)
+		if e, ok := err.(*JobBoardError); ok && e.Kind == JobBoardNotFound && method == "DELETE" && attempt > 0 {
+			// An earlier attempt deleted it even though we didn't hear back
+			return nil, nil
+		}
+		if err == nil || method == "POST" || attempt == jobBoardRetries || !retryable(ctx, err) {
+			return body, err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"operation": operation,
+			"attempt":   attempt + 1,
+		}).Warn("job board request failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// send makes a single attempt at a request, keeping track of how long it took and whether
+// it failed.
+func (jb *JobBoard) send(ctx context.Context, method, path string, form url.Values, operation string) ([]byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := jb.newRequest(method, path, body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
 
-	_, err = jb.client.Do(req)
-	return err
+	start := time.Now()
+	resp, err := jb.client.Do(req.WithContext(ctx))
+	jobBoardDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		jobBoardErrors.WithLabelValues(operation).Inc()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJobBoardResponse))
+	if err != nil {
+		jobBoardErrors.WithLabelValues(operation).Inc()
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		jobBoardErrors.WithLabelValues(operation).Inc()
+		return nil, newJobBoardError(resp.StatusCode, data)
+	}
+
+	return data, nil
+}
+
+// retryable decides whether a failed request is worth trying again. Errors from job board
+// other than server errors will just happen again, and there's no point retrying once the
+// context is done.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if e, ok := err.(*JobBoardError); ok {
+		return e.Kind == JobBoardServerError
+	}
+	return true
 }
 
 func (jb *JobBoard) newRequest(method, path string, body io.Reader) (*http.Request, error) {
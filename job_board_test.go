@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testResponse struct {
+	status int
+	body   string
+}
+
+// testJobBoard starts a server that answers each request with the next of the given
+// responses, staying on the last one, and counts the requests it gets.
+func testJobBoard(responses ...testResponse) (*JobBoard, *int, func()) {
+	jobBoardRetryDelay = time.Millisecond
+
+	var count int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := responses[len(responses)-1]
+		if count < len(responses) {
+			resp = responses[count]
+		}
+		count++
+
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	}))
+
+	return NewJobBoard(srv.URL, "secret"), &count, srv.Close
+}
+
+func TestJobBoardErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		kind    JobBoardErrorKind
+		message string
+	}{
+		{401, "Unauthorized", JobBoardAuthFailed, "job board responded with 401 Unauthorized: Unauthorized"},
+		{404, `{"error":"no such image"}`, JobBoardNotFound, "job board responded with 404 Not Found: no such image"},
+		{409, `{"message":"image already exists"}`, JobBoardConflict, "job board responded with 409 Conflict: image already exists"},
+		{500, "<html><body>Application Error</body></html>", JobBoardServerError, "job board responded with 500 Internal Server Error"},
+	}
+
+	for _, tt := range tests {
+		jb, _, done := testJobBoard(testResponse{tt.status, tt.body})
+		err := jb.RegisterImage(context.TODO(), "my-image", "xcode10")
+		done()
+
+		require.EqualError(t, err, tt.message)
+		require.Equal(t, tt.kind, err.(*JobBoardError).Kind)
+	}
+}
+
+func TestJobBoardRetriesIdempotentRequests(t *testing.T) {
+	jb, count, done := testJobBoard(testResponse{500, ""}, testResponse{500, ""}, testResponse{200, `{"data":[{"name":"my-image","tags":{"osx_image":"xcode10"}}]}`})
+	defer done()
+
+	images, err := jb.ListImages(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, []JobBoardImage{{Tag: "xcode10", Name: "my-image", Tags: map[string]string{"osx_image": "xcode10"}}}, images)
+	require.Equal(t, 3, *count)
+}
+
+func TestJobBoardGivesUpRetrying(t *testing.T) {
+	jb, count, done := testJobBoard(testResponse{500, ""})
+	defer done()
+
+	_, err := jb.ListImages(context.TODO())
+	require.Error(t, err)
+	require.Equal(t, jobBoardRetries+1, *count)
+}
+
+func TestJobBoardDoesNotRetryRegister(t *testing.T) {
+	jb, count, done := testJobBoard(testResponse{500, ""}, testResponse{200, ""})
+	defer done()
+
+	require.Error(t, jb.RegisterImage(context.TODO(), "my-image", "xcode10"))
+	require.Equal(t, 1, *count)
+}
+
+func TestJobBoardDoesNotRetryClientErrors(t *testing.T) {
+	jb, count, done := testJobBoard(testResponse{401, ""})
+	defer done()
+
+	_, err := jb.ListImages(context.TODO())
+	require.Error(t, err)
+	require.Equal(t, 1, *count)
+}
+
+func TestJobBoardDeleteAlreadyDeletedOnRetry(t *testing.T) {
+	jb, count, done := testJobBoard(testResponse{500, ""}, testResponse{404, ""})
+	defer done()
+
+	require.NoError(t, jb.DeleteImage(context.TODO(), "my-image"))
+	require.Equal(t, 2, *count)
+}
+
+func TestJobBoardHonorsContext(t *testing.T) {
+	jb, count, done := testJobBoard(testResponse{200, "{}"})
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := jb.ListImages(ctx)
+	require.Error(t, err)
+	require.Equal(t, 0, *count)
+}
+
+func TestRegisterImageShowsJobBoardError(t *testing.T) {
+	jb, _, done := testJobBoard(
+		testResponse{200, `{"data": []}`},
+		testResponse{409, `{"error":"image already exists"}`},
+	)
+	defer done()
+	jobBoards = map[string]*JobBoard{"staging": jb}
+	defer func() { jobBoards = nil }()
+	setupBaseImages("my-image")
+
+	conv := newTestConversation("register image my-image as xcode10 in staging")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "my-image",
+		"tag":   "xcode10",
+		"env":   "staging",
+	}))
+	RegisterImage(context.TODO(), conv)
+
+	reply := conv.replies[len(conv.replies)-1]
+	require.Equal(t, "Sorry, <@user>! I couldn't register the image with job board.", reply.text)
+	require.EqualError(t, reply.error, "job board responded with 409 Conflict: image already exists")
+}
+
+func TestFormatJobBoardTags(t *testing.T) {
+	require.Equal(t, "", formatJobBoardTags(nil))
+	require.Equal(t, "os:osx,osx_image:xcode10,xcode:10.1", formatJobBoardTags(map[string]string{
+		"xcode":     "10.1",
+		"os":        "osx",
+		"osx_image": "xcode10",
+	}))
+}
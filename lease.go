@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lease records who checked out a host and how long they get to keep it.
+type Lease struct {
+	Pod          string    `json:"pod"`
+	Host         string    `json:"host"`
+	Owner        string    `json:"owner"`
+	Channel      string    `json:"channel"`
+	CheckedOutAt time.Time `json:"checked_out_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Warned       bool      `json:"warned"`
+
+	// CheckInFailed is set when the reaper couldn't check in the host after the lease
+	// expired, so that the owner is only told about it once.
+	CheckInFailed bool `json:"check_in_failed"`
+}
+
+// Remaining returns how much time is left on the lease.
+func (l Lease) Remaining(now time.Time) time.Duration {
+	return l.ExpiresAt.Sub(now)
+}
+
+// LeaseStore keeps track of host leases.
+//
+// If the store has a path, leases are saved to that file as JSON whenever they change,
+// so they survive the bot restarting.
+type LeaseStore struct {
+	path   string
+	mu     sync.Mutex
+	leases map[string]Lease
+}
+
+// NewLeaseStore creates a lease store backed by the file at path, loading any leases
+// already saved there. An empty path creates a store that only lives in memory.
+func NewLeaseStore(path string) (*LeaseStore, error) {
+	s := &LeaseStore{
+		path:   path,
+		leases: make(map[string]Lease),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, err
+	}
+
+	for _, l := range leases {
+		s.leases[leaseKey(l.Pod, l.Host)] = l
+	}
+
+	return s, nil
+}
+
+func leaseKey(pod, host string) string {
+	return pod + "/" + host
+}
+
+// Get returns the lease for a host, if there is one.
+func (s *LeaseStore) Get(pod, host string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, found := s.leases[leaseKey(pod, host)]
+	return l, found
+}
+
+// Put adds or replaces the lease for a host.
+func (s *LeaseStore) Put(l Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leases[leaseKey(l.Pod, l.Host)] = l
+	return s.save()
+}
+
+// Update changes the lease for a host in place, so that changes made since the caller last
+// read it aren't lost. It returns the updated lease, or false if the host has no lease.
+func (s *LeaseStore) Update(pod, host string, fn func(*Lease)) (Lease, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := leaseKey(pod, host)
+	l, found := s.leases[key]
+	if !found {
+		return Lease{}, false, nil
+	}
+
+	fn(&l)
+	s.leases[key] = l
+	return l, true, s.save()
+}
+
+// Delete removes the lease for a host, if there is one.
+func (s *LeaseStore) Delete(pod, host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases, leaseKey(pod, host))
+	return s.save()
+}
+
+// All returns every lease, soonest to expire first.
+func (s *LeaseStore) All() []Lease {
+	return s.filter(func(Lease) bool { return true })
+}
+
+// ForPod returns the leases for hosts in a pod, soonest to expire first.
+func (s *LeaseStore) ForPod(pod string) []Lease {
+	return s.filter(func(l Lease) bool { return l.Pod == pod })
+}
+
+// ForOwner returns the leases held by a user, soonest to expire first.
+func (s *LeaseStore) ForOwner(user string) []Lease {
+	return s.filter(func(l Lease) bool { return l.Owner == user })
+}
+
+func (s *LeaseStore) filter(fn func(Lease) bool) []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var leases []Lease
+	for _, l := range s.leases {
+		if fn(l) {
+			leases = append(leases, l)
+		}
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].ExpiresAt.Before(leases[j].ExpiresAt)
+	})
+	return leases
+}
+
+// save writes the leases to the store's file. The caller must hold the lock.
+func (s *LeaseStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	leases := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the contents of a file without leaving it half-written
+// if the process dies partway through.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// notifyUser opens a conversation for the bot to message a user directly.
+// It is a variable so that tests can capture the messages.
+var notifyUser = NewDirectConversation
+
+// watchLeases periodically reaps expired leases until the context is done.
+func watchLeases(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			reapLeases(ctx, now)
+		}
+	}
+}
+
+// reapLeases warns the owners of leases that are about to expire, and checks in
+// the hosts for leases that have expired.
+func reapLeases(ctx context.Context, now time.Time) {
+	for _, l := range leases.All() {
+		entry := log.WithFields(log.Fields{
+			"pod":   l.Pod,
+			"host":  l.Host,
+			"owner": l.Owner,
+		})
+
+		if !now.Before(l.ExpiresAt) {
+			expireLease(ctx, entry, l, now)
+			continue
+		}
+
+		if !l.Warned && l.Remaining(now) <= leaseConfig.Warning {
+			warnLease(entry, l)
+		}
+	}
+}
+
+func warnLease(entry *log.Entry, l Lease) {
+	conv, err := notifyUser(l.Owner)
+	if err != nil {
+		entry.WithError(err).Error("could not message lease owner")
+		return
+	}
+
+	entry.Info("warning owner that lease is expiring")
+	ReplyTo(conv).
+		AttachText("Your lease on a host expires %s. Say `extend lease` to keep it for another %s, or `check in host` if you're done with it.",
+			humanize.Time(l.ExpiresAt), leaseConfig.Default).
+		Color("warning").
+		Field("Host", ":desktop_computer: %s", l.Host).
+		ShortField("Pod", l.Pod).
+		Send()
+
+	// The owner may have extended the lease while we were warning them
+	if _, _, err := leases.Update(l.Pod, l.Host, func(l *Lease) { l.Warned = true }); err != nil {
+		entry.WithError(err).Error("could not save lease")
+	}
+}
+
+func expireLease(ctx context.Context, entry *log.Entry, l Lease, now time.Time) {
+	sem := hostSemaphore(l.Pod)
+	if !sem.TryAcquire(1) {
+		entry.Info("host is busy, will try to check in expired lease later")
+		return
+	}
+	defer sem.Release(1)
+
+	// The owner may have extended the lease or checked the host in since it was read
+	l, found := leases.Get(l.Pod, l.Host)
+	if !found || now.Before(l.ExpiresAt) {
+		return
+	}
+
+	hosts, err := backend.CheckedOutHosts(ctx, l.Pod)
+	if err != nil {
+		entry.WithError(err).Error("could not list checked out hosts, will try again later")
+		return
+	}
+
+	host := findHost(hosts, l.Host)
+	if host == nil {
+		// Someone already checked the host in without going through the bot.
+		entry.Info("host for expired lease is no longer checked out")
+		if err := leases.Delete(l.Pod, l.Host); err != nil {
+			entry.WithError(err).Error("could not delete lease")
+		}
+		return
+	}
+
+	entry.Info("checking in host for expired lease")
+	err = backend.CheckInHost(ctx, l.Pod, host)
+
+	conv, convErr := notifyUser(l.Owner)
+	if convErr != nil {
+		entry.WithError(convErr).Error("could not message lease owner")
+	}
+
+	if err != nil {
+		entry.WithError(err).Error("could not check in host for expired lease")
+		if conv != nil && !l.CheckInFailed {
+			ReplyTo(conv).
+				ErrorText("Your lease on a host expired, but I couldn't check it back in. I'll keep trying.").
+				Error(err).
+				Field("Host", ":desktop_computer: %s", l.Host).
+				ShortField("Pod", l.Pod).
+				Send()
+		}
+
+		if _, _, err := leases.Update(l.Pod, l.Host, func(l *Lease) { l.CheckInFailed = true }); err != nil {
+			entry.WithError(err).Error("could not save lease")
+		}
+		return
+	}
+
+	if err := leases.Delete(l.Pod, l.Host); err != nil {
+		entry.WithError(err).Error("could not delete lease")
+	}
+
+	if conv != nil {
+		ReplyTo(conv).
+			AttachText("Your lease on a host expired, so I checked it back in.").
+			Color("good").
+			Field("Host", ":desktop_computer: %s", host.Name()).
+			ShortField("Pod", l.Pod).
+			Send()
+	}
+}
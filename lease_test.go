@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func captureNotifications() map[string]*testConversation {
+	convs := make(map[string]*testConversation)
+	notifyUser = func(user string) (Conversation, error) {
+		conv, found := convs[user]
+		if !found {
+			conv = newTestConversation("")
+			conv.channel = "D" + user
+			conv.user = user
+			convs[user] = conv
+		}
+		return conv, nil
+	}
+	return convs
+}
+
+func checkOutForTest(t *testing.T, expires time.Time) {
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	require.NoError(t, backend.CheckOutHost(context.TODO(), "pod-1", host))
+	require.NoError(t, leases.Put(Lease{
+		Pod:       "pod-1",
+		Host:      host.Name(),
+		Owner:     "owner",
+		ExpiresAt: expires,
+	}))
+}
+
+func TestLeaseStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macbot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "leases.json")
+	store, err := NewLeaseStore(path)
+	require.NoError(t, err)
+
+	expires := time.Date(2018, 11, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, store.Put(Lease{Pod: "pod-1", Host: "host-a", Owner: "owner", ExpiresAt: expires}))
+	require.NoError(t, store.Put(Lease{Pod: "pod-2", Host: "host-b", Owner: "other", ExpiresAt: expires}))
+	require.NoError(t, store.Delete("pod-2", "host-b"))
+
+	store, err = NewLeaseStore(path)
+	require.NoError(t, err)
+
+	l, found := store.Get("pod-1", "host-a")
+	require.True(t, found)
+	require.Equal(t, "owner", l.Owner)
+	require.True(t, expires.Equal(l.ExpiresAt))
+	require.Len(t, store.All(), 1)
+}
+
+func TestReapLeasesWarnsOwner(t *testing.T) {
+	resetBackend()
+	convs := captureNotifications()
+	now := time.Now()
+	checkOutForTest(t, now.Add(10*time.Minute))
+
+	reapLeases(context.TODO(), now)
+
+	require.Len(t, convs["owner"].replies, 1)
+	reply := convs["owner"].replies[0]
+	require.Contains(t, reply.text, "Say `extend lease` to keep it for another 8h0m0s")
+	require.Equal(t, "warning", reply.color)
+
+	// the owner should only be warned once
+	reapLeases(context.TODO(), now.Add(time.Minute))
+	require.Len(t, convs["owner"].replies, 1)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+}
+
+func TestWarnLeaseKeepsExtension(t *testing.T) {
+	resetBackend()
+	captureNotifications()
+	now := time.Now()
+	checkOutForTest(t, now.Add(10*time.Minute))
+	stale, _ := leases.Get("pod-1", "1.2.3.4")
+
+	// The owner extends the lease after it was read, but before the warning is saved
+	extended := now.Add(8 * time.Hour)
+	_, found, err := leases.Update("pod-1", "1.2.3.4", func(l *Lease) { l.ExpiresAt = extended })
+	require.NoError(t, err)
+	require.True(t, found)
+
+	warnLease(log.WithField("test", t.Name()), stale)
+
+	l, _ := leases.Get("pod-1", "1.2.3.4")
+	require.True(t, l.Warned)
+	require.True(t, extended.Equal(l.ExpiresAt))
+}
+
+func TestLeaseStoreUpdateMissingLease(t *testing.T) {
+	store, err := NewLeaseStore("")
+	require.NoError(t, err)
+
+	_, found, err := store.Update("pod-1", "host-a", func(l *Lease) { l.Warned = true })
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Empty(t, store.All())
+}
+
+func TestReapLeasesChecksInExpiredHost(t *testing.T) {
+	resetBackend()
+	convs := captureNotifications()
+	now := time.Now()
+	checkOutForTest(t, now.Add(-time.Minute))
+
+	reapLeases(context.TODO(), now)
+
+	require.False(t, isDebugHostCheckedOut("1.2.3.4"))
+	require.Empty(t, leases.All())
+
+	reply := convs["owner"].replies[0]
+	require.Equal(t, "Your lease on a host expired, so I checked it back in.", reply.text)
+	require.Equal(t, "good", reply.color)
+}
+
+func TestExpireLeaseKeepsExtension(t *testing.T) {
+	resetBackend()
+	convs := captureNotifications()
+	now := time.Now()
+	checkOutForTest(t, now.Add(-time.Minute))
+	stale, _ := leases.Get("pod-1", "1.2.3.4")
+
+	// The owner extends the lease after it was read, but before the host is checked in
+	extended := now.Add(8 * time.Hour)
+	_, _, err := leases.Update("pod-1", "1.2.3.4", func(l *Lease) { l.ExpiresAt = extended })
+	require.NoError(t, err)
+
+	expireLease(context.TODO(), log.WithField("test", t.Name()), stale, now)
+
+	require.Empty(t, convs)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+	l, found := leases.Get("pod-1", "1.2.3.4")
+	require.True(t, found)
+	require.True(t, extended.Equal(l.ExpiresAt))
+}
+
+func TestReapLeasesLeavesOtherLeasesAlone(t *testing.T) {
+	resetBackend()
+	convs := captureNotifications()
+	now := time.Now()
+	checkOutForTest(t, now.Add(3*time.Hour))
+
+	reapLeases(context.TODO(), now)
+
+	require.Empty(t, convs)
+	require.True(t, isDebugHostCheckedOut("1.2.3.4"))
+	require.Len(t, leases.All(), 1)
+}
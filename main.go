@@ -4,10 +4,10 @@ import (
 	"context"
 	"flag"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"syscall"
 	"time"
 
 	"github.com/nlopes/slack"
@@ -18,12 +18,12 @@ import (
 var backend Backend
 var imagesClient images.Images
 var jobBoards map[string]*JobBoard
+var defaultPod string
 
+var configPath = flag.String("config", "", "path to a YAML config file")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var debug = flag.Bool("debug", false, "use debugging backend, don't talk to vsphere")
-var maxQuiet = flag.Duration("maxquiet", time.Hour, "maximum time to wait for an event before exiting")
-
-var rtm *slack.RTM
+var maxQuiet = flag.Duration("maxquiet", time.Hour, "maximum time to go without an event before the slack connection is reported unhealthy")
 
 func main() {
 	log.SetLevel(log.DebugLevel)
@@ -33,74 +33,160 @@ func main() {
 	if *cpuprofile != "" {
 		measureCPUUsage(*cpuprofile)
 	}
-	setupInterruptHandler()
 
-	setupBackend()
-	setupImagesClient()
-	setupJobBoards()
+	cfg := loadConfig()
+	setupBackend(cfg)
+	setupImagesClient(cfg)
+	setupJobBoards(cfg)
+	setupLeases(cfg)
+	setupBuildWatches(cfg)
+	setupSchedules(cfg)
+	setupAuditLog(cfg)
+	setupTagHistory(cfg)
 
 	token := os.Getenv("SLACK_API_TOKEN")
 	api := slack.New(token)
+	setupSlackClient(api)
 
-	rtm = api.NewRTM()
-	go rtm.ManageConnection()
+	go watchLeases(context.Background(), time.Minute)
+	resumeBuildWatches(context.Background())
 
 	router := NewRouter()
+	router.Roles = setupRoles(cfg, api)
+	addCommands(router)
+
+	confirmations.Timeout = cfg.ConfirmTimeout
+	router.HandleAction("confirm", confirmations.HandleAction)
+
+	approvals.Timeout = cfg.ApprovalTimeout
+	approvals.Roles = router.Roles
+	router.HandleAction("approve", approvals.HandleAction)
+
+	operations.Roles = router.Roles
+	operations.Role = roleOperator
+
+	setupShutdownHandler(cfg, router)
+	go watchSchedules(context.Background(), router, time.Minute)
+
+	if cfg.Slack.Mode == slackModeEvents {
+		// Slack sends events to us, so there's no connection that could go down
+		slackHealth.MaxQuiet = 0
+		slackHealth.Connected()
+		serveHTTP(cfg, router)
+		return
+	}
+
+	// MaxQuiet isn't guarded by a lock, so it has to be set before /healthz is served
+	slackHealth.MaxQuiet = *maxQuiet
+	go serveHTTP(cfg, router)
+	if err := listenRTM(api, router, cfg.Slack.MaxReconnects); err != nil {
+		log.WithError(err).Error("giving up on slack, waiting for running commands to finish")
+		shutdown(router, cfg.ShutdownTimeout)
+		log.Fatal("exiting because the bot can't connect to slack")
+	}
+}
+
+// addCommands registers every command the bot answers. Patterns match anywhere in a message and
+// the first one that matches wins, so commands that contain other commands have to come before
+// them. Schedules come first, since the command being scheduled would match on its own.
+func addCommands(router *Router) {
+	router.HandleFunc("schedule <command> every <spec> in <channel>", ScheduleCommand(router))
+	router.HandleFunc("schedule <command> every <spec>", ScheduleCommand(router))
+	router.HandleFunc("list schedules", ListSchedules)
+	router.HandleFunc("unschedule <schedule>", UnscheduleCommand(router.Roles))
+
+	router.HandleFunc("delete unused base images older than <age> in <pod>", DeleteUnusedBaseImages, roleOperator)
+	router.HandleFunc("delete unused base vms older than <age> in <pod>", DeleteUnusedBaseImages, roleOperator)
+	router.HandleFunc("delete unused base images older than <age>", DeleteUnusedBaseImages, roleOperator)
+	router.HandleFunc("delete unused base vms older than <age>", DeleteUnusedBaseImages, roleOperator)
+	router.HandleFunc("unused base images in <pod>", UnusedBaseImages)
+	router.HandleFunc("unused base vms in <pod>", UnusedBaseImages)
+	router.HandleFunc("unused base images", UnusedBaseImages)
+	router.HandleFunc("unused base vms", UnusedBaseImages)
+	router.HandleFunc("base images in <pod>", BaseImages)
+	router.HandleFunc("base vms in <pod>", BaseImages)
 	router.HandleFunc("base images", BaseImages)
 	router.HandleFunc("base vms", BaseImages)
-	router.HandleFunc("restore backup <image>", RestoreBackup)
+	router.HandleFunc("restore backup <image> in <pod>", RestoreBackup, roleOperator)
+	router.HandleFunc("restore backup <image>", RestoreBackup, roleOperator)
 
+	router.HandleFunc("checked out hosts in <pod>", IsHostCheckedOut)
+	router.HandleFunc("checked out in <pod>", IsHostCheckedOut)
+	router.HandleFunc("is checked out in <pod>", IsHostCheckedOut)
+	router.HandleFunc("checked out hosts", IsHostCheckedOut)
 	router.HandleFunc("checked out", IsHostCheckedOut)
 	router.HandleFunc("is checked out", IsHostCheckedOut)
-	router.HandleFunc("checkout host", CheckOutHost)
-	router.HandleFunc("check out host", CheckOutHost)
-	router.HandleFunc("checkin host", CheckInHost)
-	router.HandleFunc("check in host", CheckInHost)
+	router.HandleFunc("check out <count> hosts in <pod> for <duration>", CheckOutHost, roleOperator)
+	router.HandleFunc("check out <count> hosts for <duration>", CheckOutHost, roleOperator)
+	router.HandleFunc("check out <count> hosts in <pod>", CheckOutHost, roleOperator)
+	router.HandleFunc("check out <count> hosts", CheckOutHost, roleOperator)
+	router.HandleFunc("checkout host in <pod> for <duration>", CheckOutHost, roleOperator)
+	router.HandleFunc("check out host in <pod> for <duration>", CheckOutHost, roleOperator)
+	router.HandleFunc("checkout host for <duration>", CheckOutHost, roleOperator)
+	router.HandleFunc("check out host for <duration>", CheckOutHost, roleOperator)
+	router.HandleFunc("checkout host in <pod>", CheckOutHost, roleOperator)
+	router.HandleFunc("check out host in <pod>", CheckOutHost, roleOperator)
+	router.HandleFunc("checkout host", CheckOutHost, roleOperator)
+	router.HandleFunc("check out host", CheckOutHost, roleOperator)
+	router.HandleFunc("extend lease by <duration>", ExtendLease, roleOperator)
+	router.HandleFunc("extend lease", ExtendLease, roleOperator)
+	// These have to come before the patterns with a host, which would otherwise match them
+	// with an empty host and pod.
+	router.HandleFunc("checkin host in <pod>", CheckInHost, roleOperator)
+	router.HandleFunc("check in host in <pod>", CheckInHost, roleOperator)
+	router.HandleFunc("checkin host <host> in <pod>", CheckInHost, roleOperator)
+	router.HandleFunc("check in host <host> in <pod>", CheckInHost, roleOperator)
+	router.HandleFunc("checkin host <host>", CheckInHost, roleOperator)
+	router.HandleFunc("check in host <host>", CheckInHost, roleOperator)
+	router.HandleFunc("checkin host", CheckInHost, roleOperator)
+	router.HandleFunc("check in host", CheckInHost, roleOperator)
 
 	router.HandleFunc("last build of <image>", LastImageBuild)
 	router.HandleFunc("last build for <image>", LastImageBuild)
-	router.HandleFunc("build image <image> at <branch>", BuildImage)
-	router.HandleFunc("build image <image>", BuildImage)
+	router.HandleFunc("build image <image> at <branch>", BuildImage, roleReleaser)
+	router.HandleFunc("build image <image>", BuildImage, roleReleaser)
+	router.HandleFunc("release image <image> at <branch> as <tag>", ReleaseImage, roleReleaser)
+	router.HandleFunc("release image <image> as <tag>", ReleaseImage, roleReleaser)
 
+	router.HandleFunc("registered images in <env> on <infra>", ListImages)
+	router.HandleFunc("job board images in <env> on <infra>", ListImages)
 	router.HandleFunc("registered images in <env>", ListImages)
 	router.HandleFunc("job board images in <env>", ListImages)
 	router.HandleFunc("registered images", ListImages)
 	router.HandleFunc("job board images", ListImages)
-	router.HandleFunc("register image <image> as <tag> in <env>", RegisterImage)
-	router.HandleFunc("register image <image> as <tag>", RegisterImage)
-	router.HandleFunc("unregister image <image> in <env>", UnregisterImage)
-	router.HandleFunc("unregister image <image>", UnregisterImage)
-
-	log.Info("listening for incoming slack events")
-
-	lastEvent := make(chan interface{})
-	go watchForDisconnect(lastEvent)
-
-	for msg := range rtm.IncomingEvents {
-		// reset inactivity timer
-		lastEvent <- struct{}{}
-
-		ctx := context.Background()
-		switch ev := msg.Data.(type) {
-		case *slack.MessageEvent:
-			dispatchCommand(ctx, router, ev)
-		default:
-			// ignore
-		}
-	}
-}
-
-func watchForDisconnect(lastEvent chan interface{}) {
-	t := time.NewTimer(*maxQuiet)
-	for {
-		select {
-		case <-lastEvent:
-			t.Reset(*maxQuiet)
-		case <-t.C:
-			log.Info("exiting due to inactivity")
-			os.Exit(1)
-		}
-	}
+	router.HandleFunc("force register image <image> as <tag> in <env> on <infra>", ForceRegisterImage, roleReleaser)
+	router.HandleFunc("force register image <image> as <tag> in <env>", ForceRegisterImage, roleReleaser)
+	router.HandleFunc("force register image <image> as <tag>", ForceRegisterImage, roleReleaser)
+	router.HandleFunc("register image <image> as <tag> in <env> on <infra>", RegisterImage, roleReleaser)
+	router.HandleFunc("register image <image> as <tag> in <env>", RegisterImage, roleReleaser)
+	router.HandleFunc("register image <image> as <tag>", RegisterImage, roleReleaser)
+	router.HandleFunc("unregister image <image> in <env> on <infra>", UnregisterImage, roleReleaser)
+	router.HandleFunc("unregister image <image> in <env>", UnregisterImage, roleReleaser)
+	router.HandleFunc("unregister image <image>", UnregisterImage, roleReleaser)
+	router.HandleFunc("set tag <tag> on image <image> in <env> on <infra>", SetImageTag, roleReleaser)
+	router.HandleFunc("set tag <tag> on image <image> in <env>", SetImageTag, roleReleaser)
+	router.HandleFunc("set tag <tag> on image <image>", SetImageTag, roleReleaser)
+	router.HandleFunc("diff images <from> <to>", DiffImages)
+	router.HandleFunc("diff images", DiffImages)
+	router.HandleFunc("promote image <tag> from <from> to <to>", PromoteImage, roleReleaser)
+	router.HandleFunc("promote image <tag>", PromoteImage, roleReleaser)
+	router.HandleFunc("tag history <tag> in <env> on <infra>", ShowTagHistory)
+	router.HandleFunc("tag history <tag> in <env>", ShowTagHistory)
+	router.HandleFunc("tag history <tag>", ShowTagHistory)
+	router.HandleFunc("rollback tag <tag> in <env> on <infra>", RollbackTag, roleReleaser)
+	router.HandleFunc("rollback tag <tag> in <env>", RollbackTag, roleReleaser)
+	router.HandleFunc("rollback tag <tag>", RollbackTag, roleReleaser)
+
+	router.HandleFunc("approve <request>", ApproveRequest, roleReleaser)
+	router.HandleFunc("reject <request>", RejectRequest)
+
+	router.HandleFunc("audit log for <user> since <duration>", AuditLogEntries, roleOperator)
+	router.HandleFunc("audit log for <user>", AuditLogEntries, roleOperator)
+	router.HandleFunc("audit log since <duration>", AuditLogEntries, roleOperator)
+	router.HandleFunc("audit log", AuditLogEntries, roleOperator)
+
+	router.HandleFunc("running operations", RunningOperations)
+	router.HandleFunc("cancel <operation>", CancelOperation)
 }
 
 func dispatchCommand(ctx context.Context, router *Router, msg *slack.MessageEvent) {
@@ -118,12 +204,19 @@ func measureCPUUsage(profile string) {
 	}
 }
 
-func setupInterruptHandler() {
+// setupShutdownHandler shuts the bot down gracefully when it is interrupted or Docker asks it
+// to stop.
+func setupShutdownHandler(cfg *Config, router *Router) {
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-signalChan
-		log.Info("received interrupt, shutting down")
+		sig := <-signalChan
+		log.WithFields(log.Fields{
+			"signal":  sig,
+			"timeout": cfg.ShutdownTimeout,
+		}).Info("shutting down, waiting for running commands")
+		shutdown(router, cfg.ShutdownTimeout)
+
 		if *cpuprofile != "" {
 			log.Info("writing CPU profile")
 			pprof.StopCPUProfile()
@@ -132,83 +225,221 @@ func setupInterruptHandler() {
 	}()
 }
 
-func setupBackend() {
+func loadConfig() *Config {
+	cfg, err := LoadConfig(*configPath, os.Getenv)
+	if err != nil {
+		log.WithError(err).WithField("path", *configPath).Fatal("could not load config")
+	}
+
+	if err := cfg.Validate(*debug); err != nil {
+		if cerr, ok := err.(*ConfigError); ok {
+			for _, problem := range cerr.Problems {
+				log.WithField("problem", problem).Error("invalid config")
+			}
+		}
+		log.Fatal("config has problems, exiting")
+	}
+
+	return cfg
+}
+
+func setupBackend(cfg *Config) {
 	var backend string
 	if *debug {
 		backend = "debug"
 		setupDebugBackend()
 	} else {
 		backend = "vsphere"
-		setupVSphereBackend()
+		setupVSphereBackend(cfg)
 	}
-
-	log.WithField("backend", backend).Info("set up backend")
+	defaultPod = cfg.DefaultPod
+	defaultBackupPod = cfg.DefaultBackupPod
+	backupPods = cfg.BackupPods()
+	maxCheckedOutHosts = cfg.HostLimits()
+	keepUnusedBaseImages = cfg.UnusedBaseImagesToKeep()
+
+	log.WithFields(log.Fields{
+		"backend":            backend,
+		"default_pod":        defaultPod,
+		"default_backup_pod": defaultBackupPod,
+	}).Info("set up backend")
 }
 
 func setupDebugBackend() {
-	backend = &DebugBackend{
-		Host: DebugHost("1.2.3.4"),
-	}
+	backend = NewDebugBackend("1.2.3.4", "1.2.3.5", "1.2.3.6")
 }
 
-func setupVSphereBackend() {
-	pod1URL, err := url.Parse(os.Getenv("VSPHERE_POD1_URL"))
-	if err != nil {
-		log.WithError(err).Fatal("could not parse pod-1 url")
-	}
+func setupVSphereBackend(cfg *Config) {
+	backend = instrumentedBackend{&VSphereBackend{
+		Datacenters: cfg.Datacenters(),
+	}}
+}
 
-	pod2URL, err := url.Parse(os.Getenv("VSPHERE_POD2_URL"))
-	if err != nil {
-		log.WithError(err).Fatal("could not parse pod-2 url")
-	}
-
-	backend = &VSphereBackend{
-		Pod1: DatacenterConfig{
-			URL:             pod1URL,
-			Insecure:        true,
-			ProdClusterPath: "/pod-1/host/MacPro_Pod_1",
-			DevClusterPath:  "/pod-1/host/packer_image_dev",
-			BaseImagePath:   "/pod-1/vm/Base VMs",
-		},
-		Pod2: DatacenterConfig{
-			URL:             pod2URL,
-			Insecure:        true,
-			ProdClusterPath: "/pod-2/host/MacPro_Pod_2",
-			BaseImagePath:   "/pod-2/vm/Base VMs",
-			BackupImagePath: "/pod-2/vm/VM Backups",
-			DatastorePath:   "/pod-2/datastore/DataCore1_4",
-		},
-	}
-}
-
-func setupImagesClient() {
-	url := os.Getenv("MACBOT_IMAGED_URL")
-	imagesClient = images.NewImagesProtobufClient(url, &http.Client{})
+func setupImagesClient(cfg *Config) {
+	url := cfg.Imaged.URL
+	imagesClient = instrumentedImages{images.NewImagesProtobufClient(url, &http.Client{})}
 	log.WithField("url", url).Info("set up imaged client")
 }
 
-func setupJobBoards() {
-	jobBoards = make(map[string]*JobBoard)
+func setupJobBoards(cfg *Config) {
+	if *debug {
+		setupDebugJobBoards(cfg)
+		return
+	}
 
-	url := os.Getenv("MACBOT_JOB_BOARD_PRODUCTION_URL")
-	password := os.Getenv("MACBOT_JOB_BOARD_PRODUCTION_PASSWORD")
+	jobBoards = make(map[string]*JobBoard)
 
-	if url != "" && password != "" {
+	for _, env := range cfg.JobBoardNames() {
+		jb := cfg.JobBoards[env]
 		log.WithFields(log.Fields{
-			"env": "production",
-			"url": url,
+			"env":              env,
+			"url":              jb.URL,
+			"infra":            jb.Infra,
+			"require_approval": jb.RequireApproval,
 		}).Info("set up job board")
-		jobBoards["production"] = NewJobBoard(url, password)
+		jobBoards[env] = NewJobBoard(jb.URL, jb.Password).OnInfra(jb.Infra)
+	}
+	requireApproval = cfg.ApprovalRequired()
+	jobBoardPods = cfg.JobBoardPods()
+}
+
+// setupDebugJobBoards starts a fake job board for each configured environment, or for
+// production and staging if none are configured, so that debug mode never changes the real
+// ones.
+func setupDebugJobBoards(cfg *Config) {
+	jobBoards = make(map[string]*JobBoard)
+	requireApproval = cfg.ApprovalRequired()
+	jobBoardPods = cfg.JobBoardPods()
+
+	envs := cfg.JobBoardNames()
+	if len(envs) == 0 {
+		envs = []string{"production", "staging"}
+		requireApproval["production"] = true
+	}
+
+	for _, env := range envs {
+		url, err := startFakeJobBoard(NewFakeJobBoard("debug"))
+		if err != nil {
+			log.WithError(err).WithField("env", env).Fatal("could not start fake job board")
+		}
+
+		log.WithFields(log.Fields{
+			"env":              env,
+			"url":              url,
+			"require_approval": requireApproval[env],
+		}).Info("set up fake job board")
+		jobBoard := NewJobBoard(url, "debug")
+		if jb, found := cfg.JobBoards[env]; found {
+			jobBoard = jobBoard.OnInfra(jb.Infra)
+		}
+		jobBoards[env] = jobBoard
 	}
+}
 
-	url = os.Getenv("MACBOT_JOB_BOARD_STAGING_URL")
-	password = os.Getenv("MACBOT_JOB_BOARD_STAGING_PASSWORD")
+func setupRoles(cfg *Config, api *slack.Client) *Roles {
+	if len(cfg.Roles) == 0 {
+		log.Warn("no roles are configured, every user can run every command")
+		return nil
+	}
 
-	if url != "" && password != "" {
+	for _, name := range cfg.RoleNames() {
 		log.WithFields(log.Fields{
-			"env": "staging",
-			"url": url,
-		}).Info("set up job board")
-		jobBoards["staging"] = NewJobBoard(url, password)
+			"role":   name,
+			"users":  len(cfg.Roles[name].Users),
+			"groups": len(cfg.Roles[name].Groups),
+		}).Info("set up role")
+	}
+	return NewRoles(cfg.Roles, api.GetUserGroupMembersContext)
+}
+
+func setupLeases(cfg *Config) {
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		log.WithError(err).WithField("dir", cfg.StateDir).Fatal("could not create state directory")
 	}
+
+	path := cfg.StatePath("leases.json")
+	store, err := NewLeaseStore(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Fatal("could not load host leases")
+	}
+
+	leases = store
+	leaseConfig = cfg.Leases
+	log.WithFields(log.Fields{
+		"path":    path,
+		"default": leaseConfig.Default,
+		"max":     leaseConfig.Max,
+	}).Info("set up host leases")
+}
+
+func setupBuildWatches(cfg *Config) {
+	path := cfg.StatePath("builds.json")
+	store, err := NewBuildWatchStore(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Fatal("could not load build watches")
+	}
+
+	buildWatches = store
+	log.WithField("path", path).Info("set up build watches")
+}
+
+func setupSchedules(cfg *Config) {
+	path := cfg.StatePath("schedules.json")
+	store, err := NewScheduleStore(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Fatal("could not load schedules")
+	}
+
+	schedules = store
+	log.WithField("path", path).Info("set up schedules")
+}
+
+func serveHTTP(cfg *Config, router *Router) {
+	if cfg.Slack.SigningSecret == "" && (cfg.Slack.Mode == slackModeEvents || !cfg.Slack.DisableActions) {
+		log.Warn("no slack signing secret is configured, requests from slack will not be verified")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", HealthHandler(slackHealth))
+	mux.Handle("/metrics", MetricsHandler())
+	if !cfg.Slack.DisableActions {
+		mux.Handle("/slack/actions", ActionHandler(router, cfg.Slack.SigningSecret))
+	}
+	if cfg.Slack.Mode == slackModeEvents {
+		mux.Handle("/slack/events", EventHandler(router, cfg.Slack.SigningSecret))
+		mux.Handle("/slack/commands", SlashCommandHandler(router, cfg.Slack.SigningSecret))
+	}
+
+	log.WithField("addr", cfg.HTTP.Listen).Info("listening for http requests")
+	if err := http.ListenAndServe(cfg.HTTP.Listen, mux); err != nil {
+		log.WithError(err).Fatal("could not serve http requests")
+	}
+}
+
+func setupSlackClient(api *slack.Client) {
+	slackClient = api
+
+	auth, err := api.AuthTest()
+	if err != nil {
+		log.WithError(err).Fatal("could not look up the bot's slack user")
+	}
+
+	botUserID = auth.UserID
+	log.WithFields(log.Fields{
+		"user": auth.User,
+		"id":   auth.UserID,
+		"team": auth.Team,
+	}).Info("set up slack client")
+}
+
+func setupAuditLog(cfg *Config) {
+	path := cfg.StatePath("audit.jsonl")
+	auditLog = NewAuditLog(path)
+	log.WithField("path", path).Info("set up audit log")
+}
+
+func setupTagHistory(cfg *Config) {
+	path := cfg.StatePath("tags.jsonl")
+	tagHistory = NewTagHistory(path)
+	log.WithField("path", path).Info("set up tag history")
 }
@@ -17,6 +17,10 @@ type MessageBuilder struct {
 	fields       []messageField
 	timestamp    string
 	footer       *messageFooter
+	callbackID   string
+	buttons      []messageButton
+	inThread     bool
+	broadcast    bool
 }
 
 type messageField struct {
@@ -30,6 +34,12 @@ type messageFooter struct {
 	time time.Time
 }
 
+type messageButton struct {
+	name  string
+	text  string
+	style string
+}
+
 // ReplyTo creates a MessageBuilder for a conversation, starting with an
 // empty message.
 func ReplyTo(c Conversation) *MessageBuilder {
@@ -113,6 +123,25 @@ func (b *MessageBuilder) addField(short bool, title string, text string, args ..
 	})
 }
 
+// ReplaceField changes the value of the field with the given title, or adds it as a
+// long field if the message doesn't have one yet.
+//
+// This forces the message to be sent as an attachment.
+func (b *MessageBuilder) ReplaceField(title string, text string, args ...interface{}) *MessageBuilder {
+	for i, f := range b.fields {
+		if f.title == title {
+			// Copy the fields so that messages that were already sent aren't changed
+			fields := append([]messageField(nil), b.fields...)
+			fields[i].value = fmt.Sprintf(text, args...)
+			b.fields = fields
+			return b
+		}
+	}
+
+	return b.Field(title, text, args...)
+}
+
+// ClearFields removes all of the fields from the attachment for the message.
 func (b *MessageBuilder) ClearFields() *MessageBuilder {
 	b.fields = nil
 	return b
@@ -127,6 +156,60 @@ func (b *MessageBuilder) Footer(text string, time time.Time) *MessageBuilder {
 	return b
 }
 
+// CallbackID sets the ID Slack will send back when a user clicks one of the message's buttons.
+func (b *MessageBuilder) CallbackID(id string) *MessageBuilder {
+	b.callbackID = id
+	return b
+}
+
+// Button adds a button to the attachment for the message. When a user clicks the button,
+// Slack sends an action with the message's callback ID and the button's name.
+//
+// Style can be "primary", "danger", or empty for a default button.
+//
+// This forces the message to be sent as an attachment.
+func (b *MessageBuilder) Button(name string, text string, style string) *MessageBuilder {
+	b.isAttachment = true
+	b.buttons = append(b.buttons, messageButton{
+		name:  name,
+		text:  text,
+		style: style,
+	})
+	return b
+}
+
+// ClearButtons removes all of the buttons from the message.
+func (b *MessageBuilder) ClearButtons() *MessageBuilder {
+	b.buttons = nil
+	return b
+}
+
+// InThread sends the message as a reply in a thread under the message that started the
+// conversation, to keep progress updates for long operations out of busy channels.
+//
+// If the conversation can't be threaded, like a slash command, the message is sent to the
+// channel as usual.
+func (b *MessageBuilder) InThread() *MessageBuilder {
+	b.inThread = true
+	return b
+}
+
+// Broadcast sends the message in the conversation's thread, and also shows it in the
+// channel. This is meant for the final result of an operation whose progress was sent
+// with InThread.
+func (b *MessageBuilder) Broadcast() *MessageBuilder {
+	b.inThread = true
+	b.broadcast = true
+	return b
+}
+
+// Timestamp sets the timestamp of a message that was already sent, so that sending the
+// builder edits that message instead of sending a new one.
+func (b *MessageBuilder) Timestamp(ts string) *MessageBuilder {
+	b.timestamp = ts
+	return b
+}
+
 // Send sends the message as a reply to the conversation.
 // The message builder keeps track of the timestamp of the message, allowing
 // the same builder to be used to later update the message.
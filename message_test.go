@@ -88,3 +88,16 @@ func TestTimestampWhenSent(t *testing.T) {
 	msg = msg.Send()
 	require.NotEmpty(t, msg.timestamp)
 }
+
+func TestThreadedReplies(t *testing.T) {
+	conv := newTestConversation("some command")
+	ReplyTo(conv).Text("Working on it").InThread().Send()
+	ReplyTo(conv).Text("Done").Broadcast().Send()
+	ReplyTo(conv).Text("Hello").Send()
+
+	require.True(t, conv.replies[0].inThread)
+	require.False(t, conv.replies[0].broadcast)
+	require.True(t, conv.replies[1].inThread)
+	require.True(t, conv.replies[1].broadcast)
+	require.False(t, conv.replies[2].inThread)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Metrics are served at /metrics for Prometheus to scrape.
+var (
+	commandsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "macbot_commands_total",
+		Help: "Commands handled, by pattern and result.",
+	}, []string{"pattern", "result"})
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "macbot_command_duration_seconds",
+		Help:    "How long command handlers took to run.",
+		Buckets: latencyBuckets,
+	}, []string{"pattern"})
+	slackSendFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "macbot_slack_send_failures_total",
+		Help: "Messages that couldn't be sent to Slack.",
+	})
+	slackConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "macbot_slack_connected",
+		Help: "Whether the bot is connected to Slack.",
+	})
+	slackLatency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "macbot_slack_latency_seconds",
+		Help: "How long Slack took to answer the last ping over the RTM connection.",
+	})
+	slackReconnectFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "macbot_slack_reconnect_failures_total",
+		Help: "Failed attempts to connect to the RTM API.",
+	})
+	jobBoardDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "macbot_job_board_request_duration_seconds",
+		Help:    "How long requests to job board took.",
+		Buckets: latencyBuckets,
+	}, []string{"operation"})
+	jobBoardErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "macbot_job_board_request_errors_total",
+		Help: "Requests to job board that failed.",
+	}, []string{"operation"})
+	imagedDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "macbot_imaged_request_duration_seconds",
+		Help:    "How long requests to imaged took.",
+		Buckets: latencyBuckets,
+	}, []string{"method"})
+	imagedErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "macbot_imaged_request_errors_total",
+		Help: "Requests to imaged that failed.",
+	}, []string{"method"})
+	vsphereDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "macbot_vsphere_operation_duration_seconds",
+		Help:    "How long vSphere operations took.",
+		Buckets: taskBuckets,
+	}, []string{"operation", "result"})
+	checkedOutHosts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "macbot_checked_out_hosts",
+		Help: "Hosts currently checked out of each pod.",
+	}, []string{"pod"})
+	checkedOutLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "macbot_checked_out_hosts_limit",
+		Help: "The most hosts that can be checked out of each pod at once.",
+	}, []string{"pod"})
+)
+
+// latencyBuckets are histogram buckets in seconds for requests and command handlers.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// taskBuckets are histogram buckets in seconds for vSphere tasks, which can take a long time.
+var taskBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+func init() {
+	prometheus.MustRegister(
+		commandsHandled,
+		commandDuration,
+		slackSendFailures,
+		slackConnected,
+		slackLatency,
+		slackReconnectFailures,
+		jobBoardDuration,
+		jobBoardErrors,
+		imagedDuration,
+		imagedErrors,
+		vsphereDuration,
+		checkedOutHosts,
+		checkedOutLimit,
+	)
+}
+
+// updateHostMetrics asks the backend how many hosts are checked out of each pod, so that
+// hosts checked out without the bot are counted too.
+func updateHostMetrics(ctx context.Context) {
+	checkedOutHosts.Reset()
+	for pod, limit := range maxCheckedOutHosts {
+		checkedOutLimit.WithLabelValues(pod).Set(float64(limit))
+
+		hosts, err := backend.CheckedOutHosts(ctx, pod)
+		if err != nil {
+			log.WithError(err).WithField("pod", pod).Warn("couldn't count checked out hosts")
+			continue
+		}
+		checkedOutHosts.WithLabelValues(pod).Set(float64(len(hosts)))
+	}
+}
+
+// MetricsHandler serves the bot's metrics, counting the checked out hosts first since they
+// can be checked out and in without the bot.
+func MetricsHandler() http.Handler {
+	metrics := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updateHostMetrics(r.Context())
+		metrics.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandlerReportsHosts(t *testing.T) {
+	resetBackend()
+	checkOutForTest(t, time.Now().Add(time.Hour))
+
+	// Checked out without the bot, so it has no lease
+	host, _ := backend.SelectHost(context.TODO(), "pod-1")
+	require.NoError(t, backend.CheckOutHost(context.TODO(), "pod-1", host))
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "macbot_checked_out_hosts{pod=\"pod-1\"} 2\n")
+	require.Contains(t, w.Body.String(), "macbot_checked_out_hosts_limit{pod=\"pod-1\"} 2\n")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+var operations = NewOperations()
+
+// Operations keeps track of long-running commands, like image builds and host checkouts,
+// so that they can be listed and cancelled from chat.
+type Operations struct {
+	// Roles decides who can cancel other people's operations. If it is nil, anyone can.
+	Roles *Roles
+	// Role is the role needed to cancel an operation someone else started.
+	Role string
+
+	mu      sync.Mutex
+	nextID  int
+	running map[int]*Operation
+}
+
+// Operation is a command that is still running.
+type Operation struct {
+	ID          int
+	User        string
+	Channel     string
+	Description string
+	StartedAt   time.Time
+
+	conv      Conversation
+	cancel    context.CancelFunc
+	resumable bool
+
+	mu          sync.Mutex
+	cancelledBy string
+}
+
+// NewOperations creates an empty set of running operations.
+func NewOperations() *Operations {
+	return &Operations{
+		running: make(map[int]*Operation),
+	}
+}
+
+// Start records that a conversation's command has started a long-running operation. The
+// returned context is cancelled if someone cancels the operation, and the returned function
+// must be called once the operation is over.
+func (o *Operations) Start(ctx context.Context, conv Conversation, description string) (context.Context, *Operation, func()) {
+	return o.start(ctx, conv, description, false)
+}
+
+// StartResumable records an operation that the bot picks up again when it restarts, like
+// watching an image build. Its context is cancelled when the bot shuts down, instead of
+// waiting for it to finish.
+func (o *Operations) StartResumable(ctx context.Context, conv Conversation, description string) (context.Context, *Operation, func()) {
+	return o.start(ctx, conv, description, true)
+}
+
+func (o *Operations) start(ctx context.Context, conv Conversation, description string, resumable bool) (context.Context, *Operation, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	o.mu.Lock()
+	o.nextID++
+	op := &Operation{
+		ID:          o.nextID,
+		User:        conv.User(),
+		Channel:     conv.Channel(),
+		Description: description,
+		StartedAt:   time.Now(),
+		conv:        conv,
+		cancel:      cancel,
+		resumable:   resumable,
+	}
+	o.running[op.ID] = op
+	o.mu.Unlock()
+
+	finish := func() {
+		o.mu.Lock()
+		delete(o.running, op.ID)
+		o.mu.Unlock()
+
+		cancel()
+	}
+
+	return ctx, op, finish
+}
+
+// Running lists the operations that haven't finished yet, oldest first.
+func (o *Operations) Running() []*Operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ops := make([]*Operation, 0, len(o.running))
+	for _, op := range o.running {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].ID < ops[j].ID
+	})
+
+	return ops
+}
+
+// Cancel stops a running operation on behalf of a user. Users can always cancel their own
+// operations, but need the configured role to cancel anyone else's.
+func (o *Operations) Cancel(ctx context.Context, id int, user string) (*Operation, error) {
+	o.mu.Lock()
+	op, found := o.running[id]
+	o.mu.Unlock()
+
+	if !found {
+		return nil, fmt.Errorf("there is no operation running with ID `%d`", id)
+	}
+
+	if op.User != user && o.Roles != nil {
+		ok, err := o.Roles.HasRole(ctx, user, o.Role)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("only <@%s> or someone with the %s role can do that", op.User, o.Role)
+		}
+	}
+
+	op.mu.Lock()
+	if op.cancelledBy != "" {
+		op.mu.Unlock()
+		return nil, fmt.Errorf("<@%s> already cancelled it", op.cancelledBy)
+	}
+	op.cancelledBy = user
+	op.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"operation": id,
+		"user":      user,
+	}).Info("cancelling operation")
+	op.cancel()
+
+	return op, nil
+}
+
+// CancelledBy returns the ID of the user who cancelled the operation, or an empty string if
+// it hasn't been cancelled.
+func (op *Operation) CancelledBy() string {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return op.cancelledBy
+}
+
+// reportCancelled notes on an operation's progress message who cancelled it, and returns
+// true, if it was cancelled. Otherwise it leaves the message alone and returns false.
+func (op *Operation) reportCancelled(msg *MessageBuilder) bool {
+	user := op.CancelledBy()
+	if user == "" {
+		return false
+	}
+
+	msg.Color("warning").
+		ReplaceField("Progress", ":no_entry_sign: Cancelled by <@%s>.", user).
+		Send()
+	return true
+}
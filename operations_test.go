@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestOperationsCancel(t *testing.T) {
+	ops := NewOperations()
+	conv := newTestConversation("restore backup image")
+
+	ctx, op, done := ops.Start(context.TODO(), conv, "restore backup image in pod-1")
+	defer done()
+
+	require.Equal(t, []*Operation{op}, ops.Running())
+	require.Equal(t, "user", op.User)
+	require.Equal(t, "test", op.Channel)
+
+	_, err := ops.Cancel(context.TODO(), op.ID, "user")
+	require.NoError(t, err)
+	require.Error(t, ctx.Err())
+	require.Equal(t, "user", op.CancelledBy())
+
+	_, err = ops.Cancel(context.TODO(), op.ID, "user")
+	require.EqualError(t, err, "<@user> already cancelled it")
+}
+
+func TestOperationsFinish(t *testing.T) {
+	ops := NewOperations()
+	_, op, done := ops.Start(context.TODO(), newTestConversation("check out host"), "check out a host in pod-1")
+	done()
+
+	require.Empty(t, ops.Running())
+
+	_, err := ops.Cancel(context.TODO(), op.ID, "user")
+	require.EqualError(t, err, "there is no operation running with ID `1`")
+}
+
+func TestOperationsCancelNeedsRole(t *testing.T) {
+	ops := NewOperations()
+	ops.Roles = testRoles()
+	ops.Role = "admin"
+
+	ctx, op, done := ops.Start(context.TODO(), newTestConversation("check out host"), "check out a host in pod-1")
+	defer done()
+
+	_, err := ops.Cancel(context.TODO(), op.ID, "someone")
+	require.EqualError(t, err, "only <@user> or someone with the admin role can do that")
+	require.NoError(t, ctx.Err())
+
+	_, err = ops.Cancel(context.TODO(), op.ID, "boss")
+	require.NoError(t, err)
+	require.Equal(t, "boss", op.CancelledBy())
+}
+
+// cancellingBackend cancels every running operation when it starts restoring a backup, as if
+// someone said `cancel` while it was in progress.
+type cancellingBackend struct {
+	*DebugBackend
+}
+
+func (b cancellingBackend) RestoreBackup(ctx context.Context, pod string, image string) error {
+	for _, op := range operations.Running() {
+		operations.Cancel(ctx, op.ID, "boss")
+	}
+
+	return b.DebugBackend.RestoreBackup(ctx, pod, image)
+}
+
+func TestCancelRestoreBackup(t *testing.T) {
+	resetBackend()
+	backend = cancellingBackend{backend.(*DebugBackend)}
+
+	conv := newTestConversation("restore backup debug-base-image-2")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "debug-base-image-2",
+	}))
+
+	restoreBackup(context.TODO(), conv, "pod-1", "debug-base-image-2")
+
+	require.Len(t, conv.replies, 2)
+	reply := conv.replies[1]
+	require.Equal(t, "Restoring backup for <@user>…", reply.text)
+	require.Equal(t, "warning", reply.color)
+	require.Contains(t, reply.fields, messageField{title: "Progress", value: ":no_entry_sign: Cancelled by <@boss>."})
+	require.Empty(t, operations.Running())
+}
+
+func TestCancelOperationCommand(t *testing.T) {
+	conv := newTestConversation("cancel 0")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"operation": "0",
+	}))
+
+	CancelOperation(context.TODO(), conv)
+
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "Sorry, <@user>! I couldn't cancel that operation: there is no operation running with ID `0`.", conv.replies[0].text)
+}
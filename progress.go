@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressUpdateInterval is the least time between edits to a progress message, so that
+// long operations don't run into Slack's rate limits.
+const progressUpdateInterval = 3 * time.Second
+
+// progressBarWidth is how many characters wide progress bars are.
+const progressBarWidth = 20
+
+// ProgressFunc is told how far along an operation is, as a percentage, along with a
+// description of what it's doing.
+type ProgressFunc func(percent float32, detail string)
+
+type progressKey struct{}
+
+// withProgress returns a context that sends the progress of operations to fn.
+func withProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progressFrom returns the progress function for a context, or nil if there isn't one.
+func progressFrom(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// reportProgress tells the context's progress function how far along an operation is,
+// if it has one.
+func reportProgress(ctx context.Context, percent float32, detail string) {
+	if fn := progressFrom(ctx); fn != nil {
+		fn(percent, detail)
+	}
+}
+
+// messageProgress shows the progress of an operation by editing a message.
+type messageProgress struct {
+	msg      *MessageBuilder
+	interval time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	started     time.Time
+	lastPercent float32
+	lastSent    time.Time
+}
+
+// TrackProgress returns a context that shows the progress of backend operations in a
+// Progress field on msg, which should already have been sent.
+//
+// The message is edited at most every few seconds, except when the operation finishes.
+func TrackProgress(ctx context.Context, msg *MessageBuilder) context.Context {
+	p := &messageProgress{
+		msg:      msg,
+		interval: progressUpdateInterval,
+		now:      time.Now,
+	}
+	p.started = p.now()
+
+	return withProgress(ctx, p.update)
+}
+
+func (p *messageProgress) update(percent float32, detail string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	// Operations can be made of several tasks, each with their own progress. When a new
+	// one starts, start the estimate over.
+	if percent < p.lastPercent {
+		p.started = now
+	}
+	p.lastPercent = percent
+
+	if percent < 100 && now.Sub(p.lastSent) < p.interval {
+		return
+	}
+	p.lastSent = now
+
+	value := progressBar(percent)
+	if remaining, ok := estimateRemaining(p.started, now, percent); ok {
+		value += fmt.Sprintf(", about %s left", remaining)
+	}
+	if detail != "" {
+		value += "\n" + detail
+	}
+
+	p.msg.ReplaceField("Progress", "%s", value).Send()
+}
+
+// progressBar draws a bar showing how far along something is, like `[█████░░░░░] 50%`.
+func progressBar(percent float32) string {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	filled := int(percent / 100 * progressBarWidth)
+	return fmt.Sprintf("`[%s%s]` %.0f%%",
+		strings.Repeat("█", filled),
+		strings.Repeat("░", progressBarWidth-filled),
+		percent)
+}
+
+// estimateRemaining guesses how long is left in an operation, assuming it keeps going at
+// the same rate. There's no estimate until some progress has been made, or once it's done.
+func estimateRemaining(started, now time.Time, percent float32) (time.Duration, bool) {
+	if percent <= 0 || percent >= 100 {
+		return 0, false
+	}
+
+	elapsed := now.Sub(started)
+	remaining := time.Duration(float64(elapsed) * float64(100-percent) / float64(percent))
+	return remaining.Round(time.Second), true
+}
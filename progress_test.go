@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type testReport struct {
+	percent float32
+	detail  string
+}
+
+func (r testReport) Percentage() float32 { return r.percent }
+func (r testReport) Detail() string      { return r.detail }
+func (r testReport) Error() error        { return nil }
+
+func TestProgressBar(t *testing.T) {
+	require.Equal(t, "`[░░░░░░░░░░░░░░░░░░░░]` 0%", progressBar(0))
+	require.Equal(t, "`[██████████░░░░░░░░░░]` 50%", progressBar(50))
+	require.Equal(t, "`[████████████████████]` 100%", progressBar(120))
+}
+
+func TestEstimateRemaining(t *testing.T) {
+	start := time.Now()
+
+	_, ok := estimateRemaining(start, start.Add(time.Minute), 0)
+	require.False(t, ok)
+
+	remaining, ok := estimateRemaining(start, start.Add(10*time.Minute), 25)
+	require.True(t, ok)
+	require.Equal(t, 30*time.Minute, remaining)
+}
+
+func TestTrackProgressThrottlesUpdates(t *testing.T) {
+	conv := newTestConversation("restore backup")
+	msg := ReplyTo(conv).AttachText("Restoring…").Field("Image", "image").Send()
+
+	require.NotNil(t, progressFrom(TrackProgress(context.TODO(), msg)))
+
+	now := time.Now()
+	tracker := &messageProgress{
+		msg:      msg,
+		interval: progressUpdateInterval,
+		now:      func() time.Time { return now },
+		started:  now,
+	}
+	p := tracker.update
+
+	now = now.Add(5 * time.Second)
+	p(10, "Cloning")
+	now = now.Add(time.Second)
+	p(20, "Cloning")
+	now = now.Add(5 * time.Second)
+	p(30, "Cloning")
+	now = now.Add(time.Second)
+	p(100, "Done")
+
+	require.Len(t, conv.replies, 4)
+	require.Equal(t, "1", conv.replies[1].timestamp, "expected progress to edit the original message")
+	require.Equal(t, messageField{title: "Progress", value: "`[██░░░░░░░░░░░░░░░░░░]` 10%, about 45s left\nCloning"}, conv.replies[1].fields[1])
+	require.Contains(t, conv.replies[2].fields[1].value, "30%")
+	require.Equal(t, "`[████████████████████]` 100%\nDone", conv.replies[3].fields[1].value)
+}
+
+func TestProgressLoggerReportsProgress(t *testing.T) {
+	var reports []float32
+	ctx := withProgress(context.TODO(), func(percent float32, detail string) {
+		reports = append(reports, percent)
+	})
+
+	p := newProgressLogger(ctx)
+	ch := p.Sink()
+	ch <- testReport{percent: 10}
+	ch <- testReport{percent: 60}
+	close(ch)
+	p.Wait()
+
+	require.Equal(t, []float32{10, 60}, reports)
+}
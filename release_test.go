@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/imaged/rpc/images"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupReleaseJobBoards points the staging and production job boards at test servers that
+// record the names of the images registered in each.
+func setupReleaseJobBoards() (map[string][]string, func()) {
+	registered := make(map[string][]string)
+	jobBoards = make(map[string]*JobBoard)
+
+	var servers []*httptest.Server
+	for _, env := range releaseEnvs {
+		env := env
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				registered[env] = append(registered[env], r.FormValue("name"))
+			}
+		}))
+		servers = append(servers, srv)
+		jobBoards[env] = NewJobBoard(srv.URL, "secret")
+	}
+
+	requireApproval = map[string]bool{}
+	confirmations = NewConfirmations(time.Hour)
+	approvals = NewApprovals(time.Hour)
+
+	return registered, func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+		jobBoards = nil
+		requireApproval = nil
+	}
+}
+
+func releaseImageForTest(statuses ...images.Build_Status) *testConversation {
+	setupBaseImages("high-sierra-1000", "high-sierra-3000", "mojave-4000")
+	imagesClient = &fakeImages{statuses: statuses}
+	buildPollInterval = time.Millisecond
+
+	conv := newTestConversation("release image high-sierra as xcode10")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "high-sierra",
+		"tag":   "xcode10",
+	}))
+	ReleaseImage(context.TODO(), conv)
+	return conv
+}
+
+func TestReleaseImage(t *testing.T) {
+	registered, done := setupReleaseJobBoards()
+	defer done()
+
+	conv := releaseImageForTest(images.Build_STARTED, images.Build_SUCCEEDED)
+
+	require.Equal(t, []string{"high-sierra-3000"}, registered["staging"])
+	require.Empty(t, registered["production"])
+
+	// Every stage is reported by editing the same message
+	progress := conv.replies[len(conv.replies)-1]
+	require.NotEmpty(t, progress.timestamp)
+	require.Contains(t, progress.text, "Are you sure you want to promote it to production?")
+	require.Equal(t, []messageField{
+		{title: "Build", value: "`7` <https://example.com/build.log|Succeeded>", short: true},
+		{title: "Base VM", value: "`high-sierra-3000`", short: true},
+		{title: "Staging", value: ":white_check_mark: Registered", short: true},
+		{title: "Production", value: "Needs confirmation", short: true},
+	}, progress.fields)
+
+	clickButton(conv, "user", "confirm")
+
+	require.Equal(t, []string{"high-sierra-3000"}, registered["production"])
+
+	progress = conv.replies[len(conv.replies)-2]
+	require.NotEmpty(t, progress.timestamp)
+	require.Equal(t, "good", progress.color)
+	require.Equal(t, messageField{title: "Production", value: ":white_check_mark: Registered", short: true}, progress.fields[3])
+
+	reply := conv.replies[len(conv.replies)-1]
+	require.Equal(t, "Successfully released high-sierra image for <@user>", reply.text)
+	require.Equal(t, "", reply.timestamp)
+	require.True(t, reply.broadcast)
+}
+
+func TestReleaseImageNeedsApproval(t *testing.T) {
+	registered, done := setupReleaseJobBoards()
+	defer done()
+	requireApproval["production"] = true
+
+	conv := releaseImageForTest(images.Build_SUCCEEDED)
+
+	require.Equal(t, []string{"high-sierra-3000"}, registered["staging"])
+	progress := conv.replies[len(conv.replies)-1]
+	require.Contains(t, progress.text, "<@user> wants to promote the high-sierra image to production as `xcode10`.")
+
+	id := strings.TrimPrefix(progress.callbackID, "approve:")
+	require.NoError(t, approvals.Approve(context.TODO(), id, "approver"))
+
+	require.Equal(t, []string{"high-sierra-3000"}, registered["production"])
+	reply := conv.replies[len(conv.replies)-1]
+	require.Contains(t, reply.fields, messageField{title: "Approved by", value: "<@approver>", short: true})
+}
+
+func TestReleaseImageNeedsStagingApproval(t *testing.T) {
+	registered, done := setupReleaseJobBoards()
+	defer done()
+	requireApproval["staging"] = true
+
+	conv := releaseImageForTest(images.Build_SUCCEEDED)
+
+	require.Empty(t, registered["staging"])
+	progress := conv.replies[len(conv.replies)-1]
+	require.Contains(t, progress.text, "<@user> wants to register the high-sierra image in staging as `xcode10`.")
+	require.Equal(t, messageField{title: "Staging", value: "Needs approval", short: true}, progress.fields[2])
+
+	id := strings.TrimPrefix(progress.callbackID, "approve:")
+	require.NoError(t, approvals.Approve(context.TODO(), id, "approver"))
+
+	require.Equal(t, []string{"high-sierra-3000"}, registered["staging"])
+	require.Empty(t, registered["production"])
+	progress = conv.replies[len(conv.replies)-1]
+	require.Contains(t, progress.text, "Are you sure you want to promote it to production?")
+	require.Equal(t, messageField{title: "Staging", value: ":white_check_mark: Registered, approved by <@approver>", short: true}, progress.fields[2])
+
+	clickButton(conv, "user", "confirm")
+	require.Equal(t, []string{"high-sierra-3000"}, registered["production"])
+}
+
+func TestReleaseImageBuildFailed(t *testing.T) {
+	registered, done := setupReleaseJobBoards()
+	defer done()
+
+	conv := releaseImageForTest(images.Build_STARTED, images.Build_FAILED)
+
+	require.Empty(t, registered)
+
+	progress := conv.replies[len(conv.replies)-2]
+	require.Equal(t, "danger", progress.color)
+	require.Equal(t, messageField{title: "Build", value: ":x: Failed", short: true}, progress.fields[0])
+
+	reply := conv.replies[len(conv.replies)-1]
+	require.Equal(t, "Sorry, <@user>! The high-sierra image failed to build, so I didn't release it.", reply.text)
+	require.True(t, reply.broadcast)
+}
+
+func TestBuiltImage(t *testing.T) {
+	vms := []Image{
+		DebugImage("macos-1000"),
+		DebugImage("macos-2000"),
+		DebugImage("macos-2500"),
+		DebugImage("macos-4000"),
+		DebugImage("macos-latest"),
+	}
+
+	vm, found := builtImage(vms, &images.Build{Name: "macos", StartedAt: 1500, FinishedAt: 3000})
+	require.True(t, found)
+	require.Equal(t, "macos-2500", vm)
+
+	_, found = builtImage(vms, &images.Build{Name: "macos", StartedAt: 5000, FinishedAt: 6000})
+	require.False(t, found)
+}
+
+func TestBuiltImageOverlappingTemplates(t *testing.T) {
+	vms := []Image{
+		DebugImage("high-sierra-1000"),
+		DebugImage("high-sierra-2000"),
+		DebugImage("mojave-2500"),
+		DebugImage("mojave-xcode10-2800"),
+	}
+
+	vm, found := builtImage(vms, &images.Build{Name: "high-sierra", StartedAt: 1500, FinishedAt: 3000})
+	require.True(t, found)
+	require.Equal(t, "high-sierra-2000", vm)
+
+	vm, found = builtImage(vms, &images.Build{Name: "mojave", StartedAt: 1500, FinishedAt: 3000})
+	require.True(t, found)
+	require.Equal(t, "mojave-2500", vm)
+
+	_, found = builtImage(vms, &images.Build{Name: "catalina", StartedAt: 1500, FinishedAt: 3000})
+	require.False(t, found)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Roles that commands can require.
+const (
+	// roleOperator can check hosts in and out and restore backups.
+	roleOperator = "operator"
+	// roleReleaser can build images and change which images job board uses.
+	roleReleaser = "releaser"
+)
+
+// groupMembersTTL is how long the members of a Slack user group are cached before they
+// are looked up again.
+const groupMembersTTL = 5 * time.Minute
+
+// GroupMembersFunc looks up the IDs of the users in a Slack user group.
+type GroupMembersFunc func(ctx context.Context, group string) ([]string, error)
+
+// Roles decides which users have which roles.
+//
+// A user has a role if they are listed in it directly, or if they are a member of one of
+// its user groups.
+type Roles struct {
+	roles   map[string]*RoleConfig
+	members GroupMembersFunc
+
+	mu     sync.Mutex
+	groups map[string]cachedGroup
+}
+
+type cachedGroup struct {
+	members   map[string]bool
+	fetchedAt time.Time
+}
+
+// NewRoles creates a role checker for the configured roles, using members to look up
+// who is in a user group.
+func NewRoles(roles map[string]*RoleConfig, members GroupMembersFunc) *Roles {
+	return &Roles{
+		roles:   roles,
+		members: members,
+		groups:  make(map[string]cachedGroup),
+	}
+}
+
+// HasRole checks whether a user has a role. Roles that aren't configured have no members.
+func (r *Roles) HasRole(ctx context.Context, user string, role string) (bool, error) {
+	rc, found := r.roles[role]
+	if !found || rc == nil {
+		return false, nil
+	}
+
+	for _, u := range rc.Users {
+		if u == user {
+			return true, nil
+		}
+	}
+
+	for _, g := range rc.Groups {
+		members, err := r.groupMembers(ctx, g)
+		if err != nil {
+			return false, err
+		}
+		if members[user] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *Roles) groupMembers(ctx context.Context, group string) (map[string]bool, error) {
+	r.mu.Lock()
+	cached, found := r.groups[group]
+	r.mu.Unlock()
+
+	if found && time.Since(cached.fetchedAt) < groupMembersTTL {
+		return cached.members, nil
+	}
+
+	users, err := r.members(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]bool)
+	for _, u := range users {
+		members[u] = true
+	}
+
+	r.mu.Lock()
+	r.groups[group] = cachedGroup{members: members, fetchedAt: time.Now()}
+	r.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"group":   group,
+		"members": len(members),
+	}).Debug("looked up user group members")
+	return members, nil
+}
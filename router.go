@@ -6,11 +6,22 @@ import (
 	"github.com/shomali11/commander"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
 )
 
-// Router dispatches conversations to handler functions.
+// Router dispatches conversations to handler functions, and button clicks on interactive
+// messages to action functions.
 type Router struct {
+	// Roles decides who can run commands that require a role. If it is nil, everyone can
+	// run every command.
+	Roles *Roles
+
 	commands []command
+	actions  map[string]ActionFunc
+
+	mu       sync.Mutex
+	stopping bool
+	running  sync.WaitGroup
 }
 
 type command struct {
@@ -18,25 +29,126 @@ type command struct {
 
 	pattern string
 	handler HandlerFunc
+	roles   []string
 }
 
 // HandlerFunc is a function that can reply to a conversation.
 type HandlerFunc func(context.Context, Conversation)
 
+// Action is a click on a button in one of the bot's interactive messages.
+type Action struct {
+	// CallbackID is the callback ID of the message the button was on.
+	CallbackID string
+	// Name is the name of the button that was clicked.
+	Name string
+	// User is the ID of the user who clicked the button.
+	User string
+	// Channel is the ID of the channel the message is in.
+	Channel string
+	// MessageTimestamp is the timestamp of the message the button was on.
+	MessageTimestamp string
+}
+
+// ActionFunc is a function that can respond to an action.
+type ActionFunc func(context.Context, Action)
+
 // NewRouter creates a new router with no handlers registered.
 func NewRouter() *Router {
-	return &Router{}
+	return &Router{
+		actions: make(map[string]ActionFunc),
+	}
 }
 
 // HandleFunc registers a function as a handler for a command.
-func (r *Router) HandleFunc(pattern string, fn HandlerFunc) {
+//
+// If any roles are given, only users with at least one of them can run the command.
+func (r *Router) HandleFunc(pattern string, fn HandlerFunc, roles ...string) {
 	cmd := commander.NewCommand(pattern)
 	r.commands = append(r.commands, command{
 		Command: cmd,
 		pattern: pattern,
 		handler: fn,
+		roles:   roles,
 	})
-	log.WithField("pattern", pattern).Debug("added command to router")
+	log.WithFields(log.Fields{
+		"pattern": pattern,
+		"roles":   roles,
+	}).Debug("added command to router")
+}
+
+// HandleAction registers a function as a handler for actions on messages whose callback ID
+// starts with the given prefix, followed by a colon.
+func (r *Router) HandleAction(prefix string, fn ActionFunc) {
+	r.actions[prefix] = fn
+	log.WithField("prefix", prefix).Debug("added action to router")
+}
+
+// Act sends an action to the handler registered for its callback ID.
+// Actions that don't match a registered handler are logged and ignored.
+func (r *Router) Act(ctx context.Context, a Action) {
+	entry := log.WithFields(log.Fields{
+		"user":        a.User,
+		"channel":     a.Channel,
+		"callback_id": a.CallbackID,
+		"action":      a.Name,
+	})
+
+	if !r.start() {
+		entry.Warn("ignoring action while shutting down")
+		return
+	}
+	defer r.running.Done()
+
+	prefix := a.CallbackID
+	if i := strings.Index(prefix, ":"); i >= 0 {
+		prefix = prefix[:i]
+	}
+
+	fn, found := r.actions[prefix]
+	if !found {
+		entry.Warn("ignoring unknown action")
+		return
+	}
+
+	entry.Info("handling action")
+	fn(ctx, a)
+}
+
+// Stop makes the router turn away new commands and actions, so that the bot can shut down
+// once the ones already running have finished.
+func (r *Router) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopping = true
+}
+
+// Wait blocks until every command and action the router is handling has finished.
+func (r *Router) Wait() {
+	r.running.Wait()
+}
+
+// start counts a command or action as running, unless the router has been stopped.
+func (r *Router) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopping {
+		return false
+	}
+	r.running.Add(1)
+	return true
+}
+
+// Match returns the pattern of the command that text would run, if there is one.
+func (r *Router) Match(text string) (string, bool) {
+	for _, c := range r.commands {
+		if _, ok := c.Match(text); ok {
+			return c.pattern, true
+		}
+	}
+
+	return "", false
 }
 
 // Reply sends a conversation to a registered handler if one matches.
@@ -55,22 +167,44 @@ func (r *Router) Reply(ctx context.Context, conv Conversation) {
 	}
 
 	entry = entry.WithField("command", text)
+	if !r.start() {
+		entry.Warn("turning away command while shutting down")
+		ReplyTo(conv).ErrorText("I'm restarting right now, so I can't run `%s`. Try again in a minute.", text).Send()
+		return
+	}
+	defer r.running.Done()
+
+	audited := newAuditedConversation(conv)
+	conv = audited
 
 	for _, c := range r.commands {
 		if props, ok := c.Match(text); ok {
+			entry = entry.WithField("pattern", c.pattern)
+			audited.begin(c.pattern)
+			if !r.allowed(ctx, conv.User(), c) {
+				entry.WithField("roles", c.roles).Warn("denying command to user without role")
+				ReplyTo(conv).ErrorText("You aren't allowed to run `%s`. It needs the %s role.", c.pattern, strings.Join(c.roles, " or ")).Send()
+				audited.finish(auditDenied)
+				return
+			}
+
 			conv.SetProperties(props)
-			entry.WithField("pattern", c.pattern).Info("handling command")
+			entry.Info("handling command")
 			c.handler(ctx, conv)
+			audited.finish("")
 			return
 		}
 	}
 
+	audited.begin("")
 	if text == "help" {
 		entry.Info("sending help")
 		r.help(ctx, conv)
+		audited.finish("")
 	} else {
 		entry.Warn("handling unknown command")
 		r.unknownCommand(ctx, conv)
+		audited.finish(auditUnknown)
 	}
 }
 
@@ -78,24 +212,51 @@ func (r *Router) unknownCommand(ctx context.Context, conv Conversation) {
 	var b strings.Builder
 	b.WriteString("I don't know how to answer that.")
 
-	if len(r.commands) > 0 {
+	if list := r.commandList(ctx, conv.User()); list != "" {
 		b.WriteString(" I can respond to the following commands:\n\n")
-		b.WriteString(r.commandList())
+		b.WriteString(list)
 	}
 
 	ReplyTo(conv).ErrorText(b.String()).Send()
 }
 
 func (r *Router) help(ctx context.Context, conv Conversation) {
-	ReplyTo(conv).Text("\n" + r.commandList()).Send()
+	ReplyTo(conv).Text("\n" + r.commandList(ctx, conv.User())).Send()
 }
 
-func (r *Router) commandList() string {
+// commandList lists the commands that a user is allowed to run.
+func (r *Router) commandList(ctx context.Context, user string) string {
 	var b strings.Builder
 
 	for _, cmd := range r.commands {
-		fmt.Fprintf(&b, "• `%s`\n", cmd.pattern)
+		if r.allowed(ctx, user, cmd) {
+			fmt.Fprintf(&b, "• `%s`\n", cmd.pattern)
+		}
 	}
 
 	return b.String()
 }
+
+// allowed checks whether a user has one of the roles a command needs.
+// If a user's roles can't be looked up, they aren't allowed to run the command.
+func (r *Router) allowed(ctx context.Context, user string, c command) bool {
+	if r.Roles == nil || len(c.roles) == 0 {
+		return true
+	}
+
+	for _, role := range c.roles {
+		ok, err := r.Roles.HasRole(ctx, user, role)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"user": user,
+				"role": role,
+			}).Error("could not check if user has role")
+			continue
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -93,3 +93,59 @@ func TestRouterCommandParameters(t *testing.T) {
 	reply := conv.replies[0]
 	require.Equal(t, "<@user>: test command matched 'a b c' 'd e f'", reply.text)
 }
+
+func TestRouterAct(t *testing.T) {
+	router := NewRouter()
+	var got Action
+	router.HandleAction("test", func(_ context.Context, a Action) {
+		got = a
+	})
+
+	router.Act(context.TODO(), Action{CallbackID: "other:1", Name: "confirm"})
+	require.Empty(t, got.Name)
+
+	router.Act(context.TODO(), Action{CallbackID: "test:1", Name: "confirm"})
+	require.Equal(t, "confirm", got.Name)
+}
+
+func testRoles() *Roles {
+	return NewRoles(map[string]*RoleConfig{
+		"admin": {Users: []string{"boss"}, Groups: []string{"S123"}},
+	}, func(_ context.Context, group string) ([]string, error) {
+		return []string{"user"}, nil
+	})
+}
+
+func TestRouterAllowsUserWithRole(t *testing.T) {
+	router := NewRouter()
+	router.Roles = testRoles()
+	router.HandleFunc("secret command", func(_ context.Context, conv Conversation) {
+		ReplyTo(conv).Text("Secret command").Send()
+	}, "admin")
+	conv := newTestConversation("secret command")
+	router.Reply(context.TODO(), conv)
+
+	require.Equal(t, "<@user>: Secret command", conv.replies[0].text)
+}
+
+func TestRouterDeniesUserWithoutRole(t *testing.T) {
+	router := NewRouter()
+	router.Roles = testRoles()
+	router.HandleFunc("secret command", func(_ context.Context, conv Conversation) {
+		ReplyTo(conv).Text("Secret command").Send()
+	}, "other")
+	router.HandleFunc("public command", func(_ context.Context, conv Conversation) {
+		ReplyTo(conv).Text("Public command").Send()
+	})
+
+	conv := newTestConversation("secret command")
+	router.Reply(context.TODO(), conv)
+
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "Sorry, <@user>! You aren't allowed to run `secret command`. It needs the other role.", conv.replies[0].text)
+
+	conv = newTestConversation("help")
+	router.Reply(context.TODO(), conv)
+
+	require.Equal(t, "<@user>: \n• `public command`\n", conv.replies[0].text)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+// listenRTM connects to Slack's Real Time Messaging API and sends incoming messages to the
+// router. The state of the connection is reported at /healthz.
+//
+// The Slack library reconnects on its own, backing off between attempts. listenRTM only
+// returns, with an error, if Slack rejects the bot's token or maxReconnects attempts to
+// reconnect fail in a row. Commands that are already running are left to finish.
+func listenRTM(api *slack.Client, router *Router, maxReconnects int) error {
+	rtm := api.NewRTM()
+	go rtm.ManageConnection()
+
+	log.Info("listening for incoming slack events")
+
+	s := &rtmSupervisor{
+		MaxReconnects: maxReconnects,
+		health:        slackHealth,
+	}
+
+	for msg := range rtm.IncomingEvents {
+		slackHealth.Event()
+
+		if err := s.handle(msg.Data); err != nil {
+			return err
+		}
+
+		if ev, ok := msg.Data.(*slack.MessageEvent); ok {
+			dispatchCommand(context.Background(), router, ev)
+		}
+	}
+
+	return errors.New("slack connection closed")
+}
+
+// rtmSupervisor keeps track of the state of the RTM connection from the events it sends.
+type rtmSupervisor struct {
+	// MaxReconnects is how many failed attempts to connect in a row are allowed before giving
+	// up. If it is zero, the supervisor never gives up.
+	MaxReconnects int
+
+	health   *ConnectionHealth
+	failures int
+}
+
+// handle updates the state of the connection for an event, returning an error if the bot
+// should give up on the connection.
+func (s *rtmSupervisor) handle(event interface{}) error {
+	switch ev := event.(type) {
+	case *slack.ConnectingEvent:
+		log.WithFields(log.Fields{
+			"attempt":    ev.Attempt,
+			"connection": ev.ConnectionCount,
+		}).Info("connecting to slack")
+	case *slack.ConnectedEvent:
+		log.WithField("connection", ev.ConnectionCount).Info("connected to slack")
+		s.failures = 0
+		s.health.Connected()
+	case *slack.DisconnectedEvent:
+		log.WithField("intentional", ev.Intentional).Warn("disconnected from slack, reconnecting")
+		s.health.Disconnected("disconnected from Slack")
+	case *slack.ConnectionErrorEvent:
+		s.failures++
+		slackReconnectFailures.Inc()
+		log.WithError(ev.ErrorObj).WithField("failures", s.failures).Warn("could not connect to slack")
+		s.health.Disconnected("could not connect to Slack: " + ev.Error())
+		if s.MaxReconnects > 0 && s.failures >= s.MaxReconnects {
+			return fmt.Errorf("could not connect to slack after %d attempts: %v", s.failures, ev.ErrorObj)
+		}
+	case *slack.InvalidAuthEvent:
+		s.health.Disconnected("Slack rejected the bot's token")
+		return errors.New("slack rejected the bot's token")
+	case *slack.LatencyReport:
+		log.WithField("latency", ev.Value).Debug("slack connection latency")
+		s.health.Latency(ev.Value)
+	}
+
+	return nil
+}
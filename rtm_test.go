@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRTMSupervisorGivesUp(t *testing.T) {
+	s := &rtmSupervisor{MaxReconnects: 2, health: NewConnectionHealth(0)}
+	connErr := &slack.ConnectionErrorEvent{ErrorObj: errors.New("connection refused")}
+
+	require.NoError(t, s.handle(&slack.ConnectedEvent{ConnectionCount: 1}))
+	require.NoError(t, s.health.Check())
+
+	require.NoError(t, s.handle(&slack.DisconnectedEvent{}))
+	require.EqualError(t, s.health.Check(), "disconnected from Slack")
+
+	require.NoError(t, s.handle(connErr))
+	require.EqualError(t, s.health.Check(), "could not connect to Slack: connection refused")
+
+	// Connecting again starts the count over
+	require.NoError(t, s.handle(&slack.ConnectedEvent{ConnectionCount: 2}))
+	require.NoError(t, s.handle(connErr))
+	require.EqualError(t, s.handle(connErr), "could not connect to slack after 2 attempts: connection refused")
+}
+
+func TestRTMSupervisorInvalidAuth(t *testing.T) {
+	s := &rtmSupervisor{health: NewConnectionHealth(0)}
+
+	require.EqualError(t, s.handle(&slack.InvalidAuthEvent{}), "slack rejected the bot's token")
+	require.EqualError(t, s.health.Check(), "Slack rejected the bot's token")
+}
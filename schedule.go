@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var schedules *ScheduleStore
+
+// Schedule is a command that runs over and over in a channel, on behalf of the user who
+// scheduled it.
+type Schedule struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Channel   string    `json:"channel"`
+	Command   string    `json:"command"`
+	Spec      string    `json:"spec"`
+	CreatedAt time.Time `json:"created_at"`
+	NextRun   time.Time `json:"next_run"`
+}
+
+// ScheduleStore keeps track of scheduled commands.
+//
+// If the store has a path, schedules are saved to that file as JSON whenever they change,
+// so they survive the bot restarting.
+type ScheduleStore struct {
+	path      string
+	mu        sync.Mutex
+	schedules map[string]Schedule
+}
+
+// NewScheduleStore creates a schedule store backed by the file at path, loading any schedules
+// already saved there. An empty path creates a store that only lives in memory.
+func NewScheduleStore(path string) (*ScheduleStore, error) {
+	s := &ScheduleStore{
+		path:      path,
+		schedules: make(map[string]Schedule),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+
+	for _, sch := range schedules {
+		s.schedules[sch.ID] = sch
+	}
+
+	return s, nil
+}
+
+// Get returns the schedule with an ID, if there is one.
+func (s *ScheduleStore) Get(id string) (Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch, found := s.schedules[id]
+	return sch, found
+}
+
+// Put adds or replaces a schedule.
+func (s *ScheduleStore) Put(sch Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules[sch.ID] = sch
+	return s.save()
+}
+
+// Delete removes a schedule, if it exists.
+func (s *ScheduleStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.schedules, id)
+	return s.save()
+}
+
+// All returns every schedule, soonest to run first.
+func (s *ScheduleStore) All() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, sch := range s.schedules {
+		schedules = append(schedules, sch)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].NextRun.Before(schedules[j].NextRun)
+	})
+	return schedules
+}
+
+// save writes the schedules to the store's file. The caller must hold the lock.
+func (s *ScheduleStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, sch := range s.schedules {
+		schedules = append(schedules, sch)
+	}
+
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// newScheduledConversation is how scheduled commands talk to their channel. It is a variable
+// so that tests can capture the messages.
+var newScheduledConversation = NewScheduledConversation
+
+// watchSchedules runs scheduled commands through the router when they're due, until the
+// context is done.
+//
+// Runs that were missed while the bot wasn't running are skipped rather than caught up on.
+func watchSchedules(ctx context.Context, router *Router, interval time.Duration) {
+	skipMissedRuns(time.Now())
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			runSchedules(ctx, router, now)
+		}
+	}
+}
+
+// skipMissedRuns moves schedules that should have run in the past to their next run
+// after now.
+func skipMissedRuns(now time.Time) {
+	for _, sch := range schedules.All() {
+		if !sch.NextRun.Before(now) {
+			continue
+		}
+
+		spec, err := ParseScheduleSpec(sch.Spec)
+		if err != nil {
+			log.WithError(err).WithField("schedule", sch.ID).Error("could not parse saved schedule")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"schedule": sch.ID,
+			"missed":   sch.NextRun,
+		}).Info("skipping missed scheduled run")
+		sch.NextRun = spec.Next(now)
+		if err := schedules.Put(sch); err != nil {
+			log.WithError(err).WithField("schedule", sch.ID).Error("could not save schedule")
+		}
+	}
+}
+
+// runSchedules starts every scheduled command that is due, and works out when each one
+// runs next.
+func runSchedules(ctx context.Context, router *Router, now time.Time) {
+	for _, sch := range schedules.All() {
+		if now.Before(sch.NextRun) {
+			continue
+		}
+
+		entry := log.WithFields(log.Fields{
+			"schedule": sch.ID,
+			"user":     sch.User,
+			"channel":  sch.Channel,
+			"command":  sch.Command,
+		})
+
+		spec, err := ParseScheduleSpec(sch.Spec)
+		if err != nil {
+			entry.WithError(err).Error("could not parse saved schedule")
+			continue
+		}
+
+		sch.NextRun = spec.Next(now)
+		if err := schedules.Put(sch); err != nil {
+			entry.WithError(err).Error("could not save schedule")
+		}
+
+		entry.Info("running scheduled command")
+		conv := newScheduledConversation(sch.User, sch.Channel, sch.Command)
+		go router.Reply(ctx, conv)
+	}
+}
+
+// describeSchedule says how often a schedule runs, for messages.
+func describeSchedule(sch Schedule) string {
+	return fmt.Sprintf("`%s` every `%s` in <#%s>", sch.Command, sch.Spec, sch.Channel)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macbot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 11, 5, 10, 30, 0, 0, time.UTC)
+	path := filepath.Join(dir, "schedules.json")
+	store, err := NewScheduleStore(path)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(Schedule{ID: "later", Command: "list schedules", Spec: "24h", NextRun: now.Add(time.Hour)}))
+	require.NoError(t, store.Put(Schedule{ID: "sooner", Command: "running operations", Spec: "1h", NextRun: now}))
+	require.NoError(t, store.Put(Schedule{ID: "gone", Command: "help", Spec: "1h", NextRun: now}))
+	require.NoError(t, store.Delete("gone"))
+
+	store, err = NewScheduleStore(path)
+	require.NoError(t, err)
+	all := store.All()
+	require.Len(t, all, 2)
+	require.Equal(t, "sooner", all[0].ID)
+	require.Equal(t, "later", all[1].ID)
+}
+
+func TestRunSchedules(t *testing.T) {
+	schedules, _ = NewScheduleStore("")
+	defer func() { schedules = nil }()
+
+	now := time.Date(2018, 11, 5, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, schedules.Put(Schedule{ID: "due", User: "user", Channel: "C123", Command: "check out host", Spec: "1h", NextRun: now}))
+	require.NoError(t, schedules.Put(Schedule{ID: "not-due", User: "user", Channel: "C123", Command: "check in host", Spec: "1h", NextRun: now.Add(time.Minute)}))
+
+	defer func() { newScheduledConversation = NewScheduledConversation }()
+	newScheduledConversation = func(user, channel, command string) Conversation {
+		conv := newTestConversation(command)
+		conv.user = user
+		conv.channel = channel
+		return conv
+	}
+
+	ran := make(chan string, 2)
+	router := NewRouter()
+	router.HandleFunc("check out host", func(_ context.Context, conv Conversation) {
+		ran <- conv.Channel() + " " + conv.CommandText()
+	})
+	router.HandleFunc("check in host", func(_ context.Context, conv Conversation) {
+		ran <- conv.Channel() + " " + conv.CommandText()
+	})
+
+	runSchedules(context.TODO(), router, now)
+
+	select {
+	case cmd := <-ran:
+		require.Equal(t, "C123 check out host", cmd)
+	case <-time.After(time.Second):
+		t.Fatal("scheduled command didn't run")
+	}
+
+	sch, _ := schedules.Get("due")
+	require.Equal(t, now.Add(time.Hour), sch.NextRun)
+	sch, _ = schedules.Get("not-due")
+	require.Equal(t, now.Add(time.Minute), sch.NextRun)
+}
+
+func TestSkipMissedRuns(t *testing.T) {
+	schedules, _ = NewScheduleStore("")
+	defer func() { schedules = nil }()
+
+	now := time.Date(2018, 11, 5, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, schedules.Put(Schedule{ID: "missed", Command: "check out host", Spec: "0 9 * * *", NextRun: now.Add(-48 * time.Hour)}))
+
+	skipMissedRuns(now)
+
+	sch, _ := schedules.Get("missed")
+	require.Equal(t, time.Date(2018, 11, 6, 9, 0, 0, 0, time.UTC), sch.NextRun)
+}
+
+func TestScheduleCommand(t *testing.T) {
+	schedules, _ = NewScheduleStore("")
+	defer func() { schedules = nil }()
+
+	router := NewRouter()
+	router.HandleFunc("check out host", CheckOutHost)
+
+	conv := newTestConversation("schedule \"check out host\" every 24h in <#c123|ops>")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"command": "\"check out host\"",
+		"spec":    "24h",
+		"channel": "<#c123|ops>",
+	}))
+	ScheduleCommand(router)(context.TODO(), conv)
+
+	all := schedules.All()
+	require.Len(t, all, 1)
+	require.Equal(t, "user", all[0].User)
+	require.Equal(t, "C123", all[0].Channel)
+	require.Equal(t, "check out host", all[0].Command)
+	require.Equal(t, "24h", all[0].Spec)
+	require.Contains(t, conv.replies[0].text, "Scheduled `check out host` every `24h` in <#C123>.")
+	require.Contains(t, conv.replies[0].text, "Say `unschedule "+all[0].ID+"` to stop it.")
+}
+
+func TestScheduleUnquotedCommand(t *testing.T) {
+	resetBackend()
+	schedules, _ = NewScheduleStore("")
+	defer func() { schedules = nil }()
+
+	router := NewRouter()
+	addCommands(router)
+
+	conv := newTestConversation("schedule check out host every 24h")
+	router.Reply(context.TODO(), conv)
+
+	all := schedules.All()
+	require.Len(t, all, 1)
+	require.Equal(t, "check out host", all[0].Command)
+	require.Equal(t, "24h", all[0].Spec)
+	require.Len(t, conv.replies, 1)
+	require.Contains(t, conv.replies[0].text, "Scheduled `check out host` every `24h`")
+}
+
+func TestScheduleCommandErrors(t *testing.T) {
+	schedules, _ = NewScheduleStore("")
+	defer func() { schedules = nil }()
+
+	router := NewRouter()
+	router.HandleFunc("check out host", CheckOutHost)
+	router.HandleFunc("schedule <command> every <spec>", ScheduleCommand(router))
+
+	tests := []struct {
+		props map[string]string
+		text  string
+	}{
+		{map[string]string{"command": "make coffee", "spec": "24h"}, "I don't know how to `make coffee`, so I can't schedule it."},
+		{map[string]string{"command": "schedule check out host every 1h", "spec": "24h"}, "I can't schedule scheduling a command."},
+		{map[string]string{"command": "check out host", "spec": "30s"}, "I can't schedule that: commands can't run more often than every 1m0s."},
+		{map[string]string{"command": "check out host", "spec": "24h", "channel": "ops"}, "I don't know which channel `ops` is. Mention it like #channel."},
+	}
+
+	for _, tt := range tests {
+		conv := newTestConversation("schedule")
+		conv.SetProperties(proper.NewProperties(tt.props))
+		ScheduleCommand(router)(context.TODO(), conv)
+
+		require.Equal(t, "Sorry, <@user>! "+tt.text, conv.replies[0].text)
+	}
+	require.Empty(t, schedules.All())
+}
+
+func TestUnscheduleCommand(t *testing.T) {
+	schedules, _ = NewScheduleStore("")
+	defer func() { schedules = nil }()
+
+	require.NoError(t, schedules.Put(Schedule{ID: "abc", User: "boss", Channel: "C123", Command: "check out host", Spec: "24h"}))
+
+	conv := newTestConversation("unschedule abc")
+	conv.user = "someone"
+	conv.SetProperties(proper.NewProperties(map[string]string{"schedule": "abc"}))
+	UnscheduleCommand(testRoles())(context.TODO(), conv)
+	require.Contains(t, conv.replies[0].text, "Only <@boss> or someone with the operator role can unschedule that.")
+
+	_, found := schedules.Get("abc")
+	require.True(t, found)
+
+	conv = newTestConversation("unschedule abc")
+	conv.user = "boss"
+	conv.SetProperties(proper.NewProperties(map[string]string{"schedule": "abc"}))
+	UnscheduleCommand(testRoles())(context.TODO(), conv)
+	require.Equal(t, "<@boss>: Unscheduled `check out host` every `24h` in <#C123>.", conv.replies[0].text)
+
+	_, found = schedules.Get("abc")
+	require.False(t, found)
+}
+
+func TestSlackChannelID(t *testing.T) {
+	require.Equal(t, "C012AB3CD", slackChannelID("<#c012ab3cd|general>"))
+	require.Equal(t, "C012AB3CD", slackChannelID("<#c012ab3cd>"))
+	require.Equal(t, "", slackChannelID("#general"))
+}
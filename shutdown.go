@@ -0,0 +1,57 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// shutdown stops the bot from taking new commands, and waits up to timeout for the ones that
+// are already running to finish.
+//
+// Users with operations in progress are told that the bot is waiting for them. If any are
+// still running when the time is up, their users are warned that they may be incomplete.
+// Operations the bot can resume after restarting, like watching image builds, are stopped
+// right away.
+func shutdown(router *Router, timeout time.Duration) {
+	router.Stop()
+
+	for _, op := range operations.Running() {
+		if op.resumable {
+			op.cancel()
+			continue
+		}
+
+		ReplyTo(op.conv).
+			Text("I'm restarting, but `%s` is still running, so I'll wait for it to finish first.", op.Description).
+			InThread().
+			Send()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		router.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("running commands finished")
+		return
+	case <-time.After(timeout):
+	}
+
+	for _, op := range operations.Running() {
+		if op.resumable {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"operation": op.ID,
+			"user":      op.User,
+		}).Warn("shutting down before operation finished")
+		ReplyTo(op.conv).
+			ErrorText("I'm restarting, so `%s` may be incomplete. Check on it before trying again.", op.Description).
+			Broadcast().
+			Send()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForCommands(t *testing.T) {
+	operations = NewOperations()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	router := NewRouter()
+	router.HandleFunc("check out host", func(ctx context.Context, conv Conversation) {
+		_, _, done := operations.Start(ctx, conv, "check out a host in pod-1")
+		defer done()
+
+		close(started)
+		<-finish
+	})
+
+	conv := newTestConversation("check out host")
+	go router.Reply(context.TODO(), conv)
+	<-started
+
+	time.AfterFunc(10*time.Millisecond, func() {
+		close(finish)
+	})
+	shutdown(router, time.Minute)
+
+	require.Len(t, conv.replies, 1)
+	require.Equal(t, "<@user>: I'm restarting, but `check out a host in pod-1` is still running, so I'll wait for it to finish first.", conv.replies[0].text)
+	require.True(t, conv.replies[0].inThread)
+
+	// New commands are turned away once the bot is shutting down
+	later := newTestConversation("check out host")
+	router.Reply(context.TODO(), later)
+	require.Len(t, later.replies, 1)
+	require.Equal(t, "Sorry, <@user>! I'm restarting right now, so I can't run `check out host`. Try again in a minute.", later.replies[0].text)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	operations = NewOperations()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	defer close(finish)
+
+	var buildCtx context.Context
+	router := NewRouter()
+	router.HandleFunc("restore backup", func(ctx context.Context, conv Conversation) {
+		_, _, done := operations.Start(ctx, conv, "restore backup image in pod-1")
+		defer done()
+
+		var doneBuild func()
+		buildCtx, _, doneBuild = operations.StartResumable(ctx, conv, "build image high-sierra at master")
+		defer doneBuild()
+
+		close(started)
+		<-finish
+	})
+
+	conv := newTestConversation("restore backup")
+	go router.Reply(context.TODO(), conv)
+	<-started
+
+	shutdown(router, 10*time.Millisecond)
+
+	// Resumable operations are stopped rather than waited for
+	require.Error(t, buildCtx.Err())
+
+	require.Len(t, conv.replies, 2)
+	require.Equal(t, "Sorry, <@user>! I'm restarting, so `restore backup image in pod-1` may be incomplete. Check on it before trying again.", conv.replies[1].text)
+	require.True(t, conv.replies[1].broadcast)
+}
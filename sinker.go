@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/vmware/govmomi/vim25/progress"
 	"sync"
 )
@@ -8,20 +9,23 @@ import (
 // copied from the real progress logger for vsphere-images commands
 // which in turn is copied from the govc progress logger
 //
-// this one is modified to not print anything
+// this one is modified to not print anything, and instead passes each report to the
+// progress function in the context, if there is one
 // the Sinker interface is surprisingly complicated to implement correctly
 
 type progressLogger struct {
 	wg sync.WaitGroup
 
-	sink chan chan progress.Report
-	done chan struct{}
+	sink   chan chan progress.Report
+	done   chan struct{}
+	report ProgressFunc
 }
 
-func newProgressLogger() *progressLogger {
+func newProgressLogger(ctx context.Context) *progressLogger {
 	p := &progressLogger{
-		sink: make(chan chan progress.Report),
-		done: make(chan struct{}),
+		sink:   make(chan chan progress.Report),
+		done:   make(chan struct{}),
+		report: progressFrom(ctx),
 	}
 
 	p.wg.Add(1)
@@ -61,6 +65,9 @@ func (p *progressLogger) loopB(ch <-chan progress.Report) error {
 				break
 			}
 			err = r.Error()
+			if p.report != nil && err == nil {
+				p.report(r.Percentage(), r.Detail())
+			}
 		}
 	}
 
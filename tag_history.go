@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tagHistory records every change the bot makes to which image a tag points to. If it is nil,
+// nothing is recorded.
+var tagHistory *TagHistory
+
+// TagChange is a record of an osx_image tag being pointed at a different image in a job
+// board environment. An empty image means the tag didn't point to anything.
+//
+// Changes recorded before infras could be chosen have no infra, and were made on the
+// default one.
+type TagChange struct {
+	Env        string    `json:"env"`
+	Infra      string    `json:"infra,omitempty"`
+	Tag        string    `json:"tag"`
+	OldImage   string    `json:"old_image"`
+	NewImage   string    `json:"new_image"`
+	User       string    `json:"user"`
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// TagHistory is an append-only log of tag changes.
+//
+// If the history has a path, changes are appended to that file as JSON lines, so they
+// survive the bot restarting. Otherwise they are only kept in memory.
+type TagHistory struct {
+	path    string
+	mu      sync.Mutex
+	changes []TagChange
+}
+
+// NewTagHistory creates a tag history that appends to the file at path. An empty path
+// creates a history that only lives in memory.
+func NewTagHistory(path string) *TagHistory {
+	return &TagHistory{path: path}
+}
+
+// Record adds a change to the history.
+func (h *TagHistory) Record(c TagChange) error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.path == "" {
+		h.changes = append(h.changes, c)
+		return nil
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Changes returns the changes made to a tag on an infra in an environment, newest first.
+func (h *TagHistory) Changes(env string, infra string, tag string) ([]TagChange, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	all, err := h.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []TagChange
+	for i := len(all) - 1; i >= 0; i-- {
+		c := all[i]
+		if c.Infra == "" {
+			c.Infra = defaultJobBoardInfra
+		}
+		if c.Env == env && c.Infra == infra && c.Tag == tag {
+			changes = append(changes, c)
+		}
+	}
+
+	return changes, nil
+}
+
+// Infras returns the infras that tags have been changed on in an environment, sorted.
+func (h *TagHistory) Infras(env string) ([]string, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	all, err := h.read()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var infras []string
+	for _, c := range all {
+		infra := c.Infra
+		if infra == "" {
+			infra = defaultJobBoardInfra
+		}
+		if c.Env == env && !seen[infra] {
+			seen[infra] = true
+			infras = append(infras, infra)
+		}
+	}
+
+	sort.Strings(infras)
+	return infras, nil
+}
+
+func (h *TagHistory) read() ([]TagChange, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.path == "" {
+		return append([]TagChange(nil), h.changes...), nil
+	}
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var changes []TagChange
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var c TagChange
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			// A partly written line shouldn't hide the rest of the history
+			log.WithError(err).WithField("path", h.path).Warn("skipping bad tag history line")
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, scanner.Err()
+}
+
+// registerTag registers an image under a tag in a job board environment, and records what
+// the tag pointed to before in the tag history.
+func registerTag(ctx context.Context, jb *JobBoard, env string, image string, tag string, user string, approver string) error {
+	var old string
+	if images, err := jb.ListImages(ctx); err != nil {
+		log.WithError(err).WithField("env", env).Warn("could not look up tag before registering image")
+	} else {
+		old = taggedImage(images, tag)
+	}
+
+	if err := jb.RegisterImage(ctx, image, tag); err != nil {
+		return err
+	}
+
+	recordTagChange(TagChange{
+		Env:        env,
+		Infra:      jb.Infra,
+		Tag:        tag,
+		OldImage:   old,
+		NewImage:   image,
+		User:       user,
+		ApprovedBy: approver,
+	})
+	return nil
+}
+
+// unregisterTags removes an image from a job board environment, and records every tag that
+// pointed to it in the tag history.
+func unregisterTags(ctx context.Context, jb *JobBoard, env string, image string, user string, approver string) error {
+	images, err := jb.ListImages(ctx)
+	if err != nil {
+		log.WithError(err).WithField("env", env).Warn("could not look up tags before unregistering image")
+	}
+
+	if err := jb.DeleteImage(ctx, image); err != nil {
+		return err
+	}
+
+	for _, i := range images {
+		if i.Name != image || i.Tag == "" {
+			continue
+		}
+
+		recordTagChange(TagChange{
+			Env:        env,
+			Infra:      jb.Infra,
+			Tag:        i.Tag,
+			OldImage:   image,
+			User:       user,
+			ApprovedBy: approver,
+		})
+	}
+	return nil
+}
+
+// setTags replaces the tags on an image in a job board environment. If that changes the
+// image's osx_image tag, both the tag it had and the tag it now has are recorded in the tag
+// history. images is the environment's current list of images.
+func setTags(ctx context.Context, jb *JobBoard, env string, images []JobBoardImage, image string, tags map[string]string, user string, approver string) error {
+	var oldTag string
+	var others []JobBoardImage
+	for _, i := range images {
+		if i.Name == image {
+			oldTag = i.Tag
+		} else {
+			others = append(others, i)
+		}
+	}
+	newTag := tags["osx_image"]
+
+	// Work out what the new tag pointed to before changing anything
+	replaced := taggedImage(images, newTag)
+
+	if err := jb.SetTags(ctx, image, tags); err != nil {
+		return err
+	}
+
+	if oldTag == newTag {
+		return nil
+	}
+	if oldTag != "" && taggedImage(images, oldTag) == image {
+		recordTagChange(TagChange{
+			Env:        env,
+			Infra:      jb.Infra,
+			Tag:        oldTag,
+			OldImage:   image,
+			NewImage:   taggedImage(others, oldTag),
+			User:       user,
+			ApprovedBy: approver,
+		})
+	}
+	if newTag != "" {
+		recordTagChange(TagChange{
+			Env:        env,
+			Infra:      jb.Infra,
+			Tag:        newTag,
+			OldImage:   replaced,
+			NewImage:   image,
+			User:       user,
+			ApprovedBy: approver,
+		})
+	}
+	return nil
+}
+
+func recordTagChange(c TagChange) {
+	c.ChangedAt = time.Now()
+	if err := tagHistory.Record(c); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"env":   c.Env,
+			"infra": c.Infra,
+			"tag":   c.Tag,
+		}).Error("could not record tag change")
+	}
+}
+
+// taggedImage returns the name of the image a tag points to, or an empty string if it
+// doesn't point to one.
+func taggedImage(images []JobBoardImage, tag string) string {
+	var name string
+	for _, i := range images {
+		if i.Tag == tag {
+			name = i.Name
+		}
+	}
+
+	return name
+}
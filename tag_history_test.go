@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"github.com/shomali11/proper"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagHistoryPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macbot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tags.jsonl")
+	h := NewTagHistory(path)
+	require.NoError(t, h.Record(TagChange{Env: "production", Tag: "xcode10", NewImage: "one"}))
+	require.NoError(t, h.Record(TagChange{Env: "staging", Tag: "xcode10", NewImage: "two"}))
+	require.NoError(t, h.Record(TagChange{Env: "production", Infra: "gce", Tag: "xcode10", NewImage: "four"}))
+	require.NoError(t, h.Record(TagChange{Env: "production", Infra: "jupiterbrain", Tag: "xcode10", OldImage: "one", NewImage: "three"}))
+
+	changes, err := NewTagHistory(path).Changes("production", "jupiterbrain", "xcode10")
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, "three", changes[0].NewImage)
+	require.Equal(t, "one", changes[1].NewImage)
+}
+
+func TestRegisterImageRecordsTagChange(t *testing.T) {
+	_, done := setupImageJobBoards(testImages)
+	defer done()
+	tagHistory = NewTagHistory("")
+	defer func() { tagHistory = nil }()
+	setupBaseImages("xcode10-2000")
+	confirmations = NewConfirmations(time.Hour)
+
+	conv := newTestConversation("register image xcode10-2000 as xcode10 in production")
+	conv.SetProperties(proper.NewProperties(map[string]string{
+		"image": "xcode10-2000",
+		"tag":   "xcode10",
+		"env":   "production",
+	}))
+	RegisterImage(context.TODO(), conv)
+	clickButton(conv, "user", "confirm")
+
+	changes, err := tagHistory.Changes("production", "jupiterbrain", "xcode10")
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "xcode10-1500", changes[0].OldImage)
+	require.Equal(t, "xcode10-2000", changes[0].NewImage)
+	require.Equal(t, "user", changes[0].User)
+	require.False(t, changes[0].ChangedAt.IsZero())
+}
+
+func TestSetTagsRecordsTagChanges(t *testing.T) {
+	jb, done := newTestFakeJobBoard()
+	defer done()
+	tagHistory = NewTagHistory("")
+	defer func() { tagHistory = nil }()
+	ctx := context.TODO()
+
+	require.NoError(t, jb.RegisterImage(ctx, "xcode10-1000", "xcode10"))
+	require.NoError(t, jb.RegisterImage(ctx, "xcode10-2000", "xcode10"))
+	require.NoError(t, jb.RegisterImage(ctx, "xcode11-1000", "xcode11"))
+	images, err := jb.ListImages(ctx)
+	require.NoError(t, err)
+
+	tags := map[string]string{"os": "osx", "osx_image": "xcode11"}
+	require.NoError(t, setTags(ctx, jb, "production", images, "xcode10-2000", tags, "user", ""))
+
+	changes, err := tagHistory.Changes("production", "jupiterbrain", "xcode10")
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "xcode10-2000", changes[0].OldImage)
+	require.Equal(t, "xcode10-1000", changes[0].NewImage)
+
+	changes, err = tagHistory.Changes("production", "jupiterbrain", "xcode11")
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "xcode11-1000", changes[0].OldImage)
+	require.Equal(t, "xcode10-2000", changes[0].NewImage)
+
+	images, err = jb.ListImages(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "xcode10-2000", taggedImage(images, "xcode11"))
+}
+
+func TestShowTagHistory(t *testing.T) {
+	tagHistory = NewTagHistory("")
+	defer func() { tagHistory = nil }()
+
+	now := time.Now()
+	tagHistory.Record(TagChange{Env: "production", Tag: "xcode10", NewImage: "one", User: "alice", ChangedAt: now})
+	tagHistory.Record(TagChange{Env: "production", Tag: "xcode10", OldImage: "one", NewImage: "two", User: "bob", ApprovedBy: "alice", ChangedAt: now})
+
+	conv := newTestConversation("tag history xcode10")
+	conv.SetProperties(proper.NewProperties(map[string]string{"tag": "xcode10"}))
+	ShowTagHistory(context.TODO(), conv)
+
+	require.Equal(t, "<@user>: Changes to `xcode10` in job-board-production on jupiterbrain:\n"+
+		"\n• <@bob> changed it from `one` to `two`, approved by <@alice>, now"+
+		"\n• <@alice> registered `one` now", conv.replies[0].text)
+}
+
+func rollbackTagForTest(tag string) *testConversation {
+	conv := newTestConversation("rollback tag " + tag)
+	conv.SetProperties(proper.NewProperties(map[string]string{"tag": tag}))
+	RollbackTag(context.TODO(), conv)
+	return conv
+}
+
+func TestRollbackTag(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+	tagHistory = NewTagHistory("")
+	defer func() { tagHistory = nil }()
+
+	tagHistory.Record(TagChange{Env: "production", Tag: "xcode10", OldImage: "xcode10-1000", NewImage: "xcode10-1500", User: "someone"})
+
+	conv := rollbackTagForTest("xcode10")
+
+	require.Equal(t, []string{"xcode10-1000 os:osx,osx_image:xcode10"}, registered["production"])
+	require.Equal(t, "Successfully rolled back tag for <@user>", conv.replies[0].text)
+
+	changes, err := tagHistory.Changes("production", "jupiterbrain", "xcode10")
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, "xcode10-1500", changes[0].OldImage)
+	require.Equal(t, "xcode10-1000", changes[0].NewImage)
+}
+
+func TestRollbackTagErrors(t *testing.T) {
+	registered, done := setupImageJobBoards(testImages)
+	defer done()
+	tagHistory = NewTagHistory("")
+	defer func() { tagHistory = nil }()
+
+	conv := rollbackTagForTest("xcode10")
+	require.Equal(t, "Sorry, <@user>! I haven't changed `xcode10` in job-board-production, so I don't know what to roll it back to.", conv.replies[0].text)
+
+	tagHistory.Record(TagChange{Env: "production", Tag: "xcode10", NewImage: "xcode10-1500", User: "someone"})
+	conv = rollbackTagForTest("xcode10")
+	require.Equal(t, "Sorry, <@user>! `xcode10` didn't point to an image in job-board-production before <@someone> registered `xcode10-1500`, so there's nothing to roll it back to.", conv.replies[0].text)
+
+	require.Empty(t, registered)
+}
+
+func TestTagHistoryInfras(t *testing.T) {
+	h := NewTagHistory("")
+	require.NoError(t, h.Record(TagChange{Env: "production", Tag: "xcode10"}))
+	require.NoError(t, h.Record(TagChange{Env: "production", Infra: "gce", Tag: "xcode10"}))
+	require.NoError(t, h.Record(TagChange{Env: "production", Infra: "gce", Tag: "xcode9"}))
+	require.NoError(t, h.Record(TagChange{Env: "staging", Infra: "ec2", Tag: "xcode10"}))
+
+	infras, err := h.Infras("production")
+	require.NoError(t, err)
+	require.Equal(t, []string{"gce", "jupiterbrain"}, infras)
+}